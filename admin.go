@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mbrancato/oidc-proxy/auth"
+)
+
+// jwksPath is the path of the JSON web key set served by the admin listener,
+// relative to the issuer path.
+const jwksPath = "/.well-known/jwks.json"
+
+// discoveryPath is the path of the OpenID Connect discovery document served by
+// the admin listener, relative to the issuer path.
+const discoveryPath = "/.well-known/openid-configuration"
+
+// A keyPublisher is a token retriever that signs tokens with keys that may be
+// published for verification, such as the manual token retriever.
+type keyPublisher interface {
+	Issuer() string
+	SigningAlgorithms() []string
+	Jwks() (*auth.JsonWebKeySet, error)
+}
+
+// healthStatus is the response body of the health check endpoint.
+type healthStatus struct {
+	Status string             `json:"status"`
+	Tokens []auth.TokenStatus `json:"tokens,omitempty"`
+}
+
+// openidConfiguration is the OpenID Connect discovery document served by the
+// admin listener.
+type openidConfiguration struct {
+	Issuer                           string   `json:"issuer"`
+	JwksUri                          string   `json:"jwks_uri"`
+	ResponseTypesSupported           []string `json:"response_types_supported"`
+	SubjectTypesSupported            []string `json:"subject_types_supported"`
+	IdTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// newAdminHandler returns the handler for the admin listener. In egress mode,
+// manager is used to report the renewal state of tokens, otherwise it is nil.
+// If publisher is not nil, its discovery document and keys are served under
+// the path of the issuer.
+func newAdminHandler(manager *auth.JwtManager, publisher keyPublisher) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, req *http.Request) {
+		health := healthStatus{Status: "ok"}
+		if manager != nil {
+			health.Tokens = manager.Status()
+			// Tokens with request claims are only renewed when requested,
+			// so they do not affect the health of the proxy.
+			for _, t := range health.Tokens {
+				if !t.Valid && !t.RequestClaims {
+					health.Status = "unavailable"
+				}
+			}
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		if health.Status != "ok" {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(rw).Encode(health)
+	})
+
+	if publisher != nil {
+		prefix := issuerPath(publisher.Issuer())
+		mux.HandleFunc(prefix+discoveryPath, func(rw http.ResponseWriter, req *http.Request) {
+			discovery := openidConfiguration{
+				Issuer:                           publisher.Issuer(),
+				JwksUri:                          jwksUri(publisher.Issuer(), req),
+				ResponseTypesSupported:           []string{"id_token"},
+				SubjectTypesSupported:            []string{"public"},
+				IdTokenSigningAlgValuesSupported: publisher.SigningAlgorithms(),
+			}
+
+			rw.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(rw).Encode(discovery)
+		})
+		mux.HandleFunc(prefix+jwksPath, func(rw http.ResponseWriter, req *http.Request) {
+			jwks, err := publisher.Jwks()
+			if err != nil {
+				rw.WriteHeader(http.StatusInternalServerError)
+				_, _ = rw.Write([]byte(err.Error()))
+				return
+			}
+
+			rw.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(rw).Encode(jwks)
+		})
+	}
+
+	return mux
+}
+
+// issuerPath returns the path of the issuer without a trailing slash, or an
+// empty string if the issuer is not an HTTP URL.
+func issuerPath(issuer string) string {
+	u, err := url.Parse(issuer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return strings.TrimSuffix(u.EscapedPath(), "/")
+}
+
+// jwksUri returns the URL of the JSON web key set. If the issuer is an HTTP
+// URL, the key set is served under the issuer, otherwise it is served from
+// the host of the request.
+func jwksUri(issuer string, req *http.Request) string {
+	u, err := url.Parse(issuer)
+	if err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+		return u.Scheme + "://" + u.Host + issuerPath(issuer) + jwksPath
+	}
+
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host + jwksPath
+}
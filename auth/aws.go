@@ -0,0 +1,333 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AwsTokenRetriever is an implementation of JwtTokenRetriever for OIDC
+// identity tokens issued to AWS workloads. Tokens are either read from the
+// web identity token file used by EKS IAM roles for service accounts, or
+// requested from the STS GetWebIdentityToken API using the workload's AWS
+// credentials.
+type AwsTokenRetriever struct {
+	source           string
+	endpoint         string
+	region           string
+	signingAlgorithm string
+	duration         int
+	roleArn          string
+	file             KubernetesTokenRetriever
+
+	mu          sync.Mutex
+	credentials awsCredentials
+}
+
+// An AwsTokenConfig contains configuration data used to initialize and
+// validate an AwsTokenRetriever object.
+type AwsTokenConfig struct {
+	Source           string        `long:"source" env:"SOURCE" description:"Source of identity tokens" choice:"web-identity-file" choice:"sts" default:"web-identity-file"`
+	TokenFile        string        `long:"token-file" env:"TOKEN_FILE" description:"Path to the web identity token file (defaults to AWS_WEB_IDENTITY_TOKEN_FILE)"`
+	ReloadInterval   time.Duration `long:"reload-interval" env:"RELOAD_INTERVAL" description:"Interval for checking the web identity token file for changes" default:"30s"`
+	Region           string        `long:"region" env:"REGION" description:"AWS region for STS requests (defaults to AWS_REGION)"`
+	StsEndpoint      string        `long:"sts-endpoint" env:"STS_ENDPOINT" description:"STS endpoint URL (defaults to the regional STS endpoint)"`
+	SigningAlgorithm string        `long:"signing-algorithm" env:"SIGNING_ALGORITHM" description:"Signing algorithm for STS issued tokens" choice:"RS256" choice:"ES384" default:"RS256"`
+	DurationSeconds  int           `long:"duration-seconds" env:"DURATION_SECONDS" description:"Lifetime of STS issued tokens in seconds" default:"300"`
+}
+
+// awsCredentials are the AWS credentials used to sign STS requests.
+type awsCredentials struct {
+	accessKeyId     string
+	secretAccessKey string
+	sessionToken    string
+	expiration      time.Time
+}
+
+// awsStsResponse contains the fields of the STS query API responses used by
+// the AwsTokenRetriever.
+type awsStsResponse struct {
+	WebIdentityToken string `xml:"GetWebIdentityTokenResult>WebIdentityToken"`
+	Credentials      struct {
+		AccessKeyId     string    `xml:"AccessKeyId"`
+		SecretAccessKey string    `xml:"SecretAccessKey"`
+		SessionToken    string    `xml:"SessionToken"`
+		Expiration      time.Time `xml:"Expiration"`
+	} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+}
+
+// awsStsError is the error response returned by the STS query API.
+type awsStsError struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// GetToken returns an identity token for the audience, either from the web
+// identity token file or from STS.
+func (r *AwsTokenRetriever) GetToken(aud string) (string, error) {
+	if r.source == "web-identity-file" {
+		return r.file.GetToken(aud)
+	}
+
+	credentials, err := r.getCredentials()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("Action", "GetWebIdentityToken")
+	form.Set("Version", "2011-06-15")
+	form.Set("Audience.member.1", aud)
+	form.Set("SigningAlgorithm", r.signingAlgorithm)
+	form.Set("DurationSeconds", strconv.Itoa(r.duration))
+
+	stsResponse, err := r.callSts(form, &credentials)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch token: %w", err)
+	}
+	if stsResponse.WebIdentityToken == "" {
+		return "", errors.New("STS response did not contain a web identity token")
+	}
+
+	return stsResponse.WebIdentityToken, nil
+}
+
+// getCredentials returns the AWS credentials from the environment, or
+// temporary credentials obtained by assuming AWS_ROLE_ARN with the web
+// identity token file.
+func (r *AwsTokenRetriever) getCredentials() (awsCredentials, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.credentials.accessKeyId != "" {
+		if r.credentials.expiration.IsZero() || time.Now().Add(5*time.Minute).Before(r.credentials.expiration) {
+			return r.credentials, nil
+		}
+	}
+
+	if r.roleArn == "" {
+		return awsCredentials{}, errors.New("no AWS credentials available")
+	}
+
+	form := url.Values{}
+	form.Set("Action", "AssumeRoleWithWebIdentity")
+	form.Set("Version", "2011-06-15")
+	form.Set("RoleArn", r.roleArn)
+	form.Set("RoleSessionName", fmt.Sprintf("oidc-proxy-%v", time.Now().Unix()))
+	form.Set("WebIdentityToken", r.file.currentToken())
+
+	stsResponse, err := r.callSts(form, nil)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to assume role with web identity: %w", err)
+	}
+	r.credentials = awsCredentials{
+		accessKeyId:     stsResponse.Credentials.AccessKeyId,
+		secretAccessKey: stsResponse.Credentials.SecretAccessKey,
+		sessionToken:    stsResponse.Credentials.SessionToken,
+		expiration:      stsResponse.Credentials.Expiration,
+	}
+	if r.credentials.accessKeyId == "" {
+		return awsCredentials{}, errors.New("STS response did not contain credentials")
+	}
+
+	return r.credentials, nil
+}
+
+// callSts sends a query API request to STS. The request is signed using
+// AWS Signature Version 4 when credentials are provided.
+func (r *AwsTokenRetriever) callSts(form url.Values, credentials *awsCredentials) (*awsStsResponse, error) {
+	client := http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	body := form.Encode()
+	req, err := http.NewRequest("POST", r.endpoint, strings.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error creating STS request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if credentials != nil {
+		signAwsRequest(req, body, r.region, "sts", *credentials, time.Now())
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		stsError := awsStsError{}
+		if xml.Unmarshal(respBody, &stsError) == nil && stsError.Code != "" {
+			return nil, fmt.Errorf("unsuccessful status code from STS: %v, %v: %v", resp.StatusCode, stsError.Code, stsError.Message)
+		}
+		return nil, fmt.Errorf("unsuccessful status code from STS: %v, %v", resp.StatusCode, string(respBody))
+	}
+
+	stsResponse := awsStsResponse{}
+	err = xml.Unmarshal(respBody, &stsResponse)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode STS response: %w", err)
+	}
+
+	return &stsResponse, nil
+}
+
+// Configure will take a valid AwsTokenConfig and use it to configure the token retriever.
+func (r *AwsTokenRetriever) Configure(config interface{}) error {
+	c, ok := config.(*AwsTokenConfig)
+	if !ok {
+		log.Fatalln("internal error: incorrect token config")
+	}
+
+	tokenFile := c.TokenFile
+	if tokenFile == "" {
+		tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+
+	switch c.Source {
+	case "web-identity-file":
+		if tokenFile == "" {
+			return unavailable(errors.New("web identity token file must be specified"))
+		}
+	case "sts":
+		if c.DurationSeconds < 60 || c.DurationSeconds > 3600 {
+			return errors.New("duration seconds must be between 60 and 3600")
+		}
+
+		r.region = c.Region
+		if r.region == "" {
+			r.region = os.Getenv("AWS_REGION")
+		}
+		if r.region == "" {
+			r.region = os.Getenv("AWS_DEFAULT_REGION")
+		}
+		if r.region == "" {
+			return errors.New("AWS region must be specified")
+		}
+
+		r.endpoint = c.StsEndpoint
+		if r.endpoint == "" {
+			r.endpoint = fmt.Sprintf("https://sts.%v.amazonaws.com", r.region)
+		}
+
+		r.credentials = awsCredentials{
+			accessKeyId:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		if r.credentials.accessKeyId == "" {
+			r.roleArn = os.Getenv("AWS_ROLE_ARN")
+			if r.roleArn == "" || tokenFile == "" {
+				return unavailable(errors.New("AWS credentials or a web identity role and token file are required for STS"))
+			}
+		}
+		if r.roleArn == "" {
+			tokenFile = ""
+		}
+	default:
+		return fmt.Errorf("unknown AWS token source: %v", c.Source)
+	}
+
+	if tokenFile != "" {
+		err := r.file.Configure(
+			&KubernetesTokenConfig{
+				TokenPath:      tokenFile,
+				ReloadInterval: c.ReloadInterval,
+			},
+		)
+		if errors.Is(err, ErrUnavailable) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read web identity token: %w", err)
+		}
+	}
+
+	r.source = c.Source
+	r.signingAlgorithm = c.SigningAlgorithm
+	r.duration = c.DurationSeconds
+	return nil
+}
+
+// signAwsRequest adds AWS Signature Version 4 headers to the request.
+func signAwsRequest(req *http.Request, body string, region string, service string, credentials awsCredentials, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if credentials.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.sessionToken)
+	}
+
+	signedHeaders := []string{"content-type", "host", "x-amz-date"}
+	if credentials.sessionToken != "" {
+		signedHeaders = append(signedHeaders, "x-amz-security-token")
+	}
+	canonicalHeaders := ""
+	for _, h := range signedHeaders {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		canonicalHeaders += fmt.Sprintf("%v:%v\n", h, strings.TrimSpace(v))
+	}
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payloadHash := sha256.Sum256([]byte(body))
+	canonicalRequest := strings.Join(
+		[]string{
+			req.Method,
+			path,
+			req.URL.RawQuery,
+			canonicalHeaders,
+			strings.Join(signedHeaders, ";"),
+			hex.EncodeToString(payloadHash[:]),
+		}, "\n",
+	)
+
+	scope := fmt.Sprintf("%v/%v/%v/aws4_request", date, region, service)
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join(
+		[]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(canonicalHash[:])}, "\n",
+	)
+
+	key := []byte("AWS4" + credentials.secretAccessKey)
+	for _, v := range []string{date, region, service, "aws4_request"} {
+		key = hmacSha256(key, v)
+	}
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set(
+		"Authorization", fmt.Sprintf(
+			"AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+			credentials.accessKeyId, scope, strings.Join(signedHeaders, ";"), signature,
+		),
+	)
+}
+
+// hmacSha256 returns the HMAC-SHA256 of data using key.
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAwsTokenRetriever_WebIdentityFile(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(tokenPath, []byte(newTestToken(t, "test-svc", "test-role")), 0600)
+	assert.NoError(t, err)
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenPath)
+
+	retriever := new(AwsTokenRetriever)
+	err = retriever.Configure(&AwsTokenConfig{Source: "web-identity-file"})
+	assert.NoError(t, err)
+
+	_, err = retriever.GetToken("test-svc")
+	assert.NoError(t, err)
+	_, err = retriever.GetToken("other-svc")
+	assert.Error(t, err)
+}
+
+func TestAwsTokenRetriever_Sts(t *testing.T) {
+	webIdentityToken := newTestToken(t, "sts.amazonaws.com", "system:serviceaccount:test-ns:test-sa")
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(tokenPath, []byte(webIdentityToken), 0600)
+	assert.NoError(t, err)
+
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(rw http.ResponseWriter, r *http.Request) {
+				assert.NoError(t, r.ParseForm())
+				switch r.PostForm.Get("Action") {
+				case "AssumeRoleWithWebIdentity":
+					assert.Empty(t, r.Header.Get("Authorization"))
+					assert.Equal(t, webIdentityToken, r.PostForm.Get("WebIdentityToken"))
+					assert.Equal(t, "arn:aws:iam::123456789012:role/test", r.PostForm.Get("RoleArn"))
+					_, _ = fmt.Fprintf(
+						rw, `<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>
+<AccessKeyId>ASIATEST</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>session</SessionToken>
+<Expiration>%v</Expiration></Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`,
+						time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+					)
+				case "GetWebIdentityToken":
+					authz := r.Header.Get("Authorization")
+					if !strings.HasPrefix(authz, "AWS4-HMAC-SHA256 Credential=ASIATEST/") ||
+						!strings.Contains(authz, "/us-west-2/sts/aws4_request") ||
+						r.Header.Get("X-Amz-Security-Token") != "session" {
+						rw.WriteHeader(http.StatusForbidden)
+						_, _ = fmt.Fprint(rw, `<ErrorResponse><Error><Code>AccessDenied</Code><Message>denied</Message></Error></ErrorResponse>`)
+						return
+					}
+					assert.Equal(t, "ES384", r.PostForm.Get("SigningAlgorithm"))
+					token := newTestToken(t, r.PostForm.Get("Audience.member.1"), "arn:aws:iam::123456789012:role/test")
+					_, _ = fmt.Fprintf(
+						rw, `<GetWebIdentityTokenResponse><GetWebIdentityTokenResult><WebIdentityToken>%v</WebIdentityToken></GetWebIdentityTokenResult></GetWebIdentityTokenResponse>`,
+						token,
+					)
+				default:
+					rw.WriteHeader(http.StatusBadRequest)
+				}
+			},
+		),
+	)
+	defer server.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/test")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenPath)
+
+	retriever := new(AwsTokenRetriever)
+	err = retriever.Configure(
+		&AwsTokenConfig{
+			Source:           "sts",
+			Region:           "us-west-2",
+			StsEndpoint:      server.URL,
+			SigningAlgorithm: "ES384",
+			DurationSeconds:  300,
+		},
+	)
+	assert.NoError(t, err)
+
+	token, err := retriever.GetToken("test-svc")
+	assert.NoError(t, err)
+	assert.NoError(t, checkTokenAudience(token, "test-svc"))
+}
+
+func TestSignAwsRequest(t *testing.T) {
+	// The post-x-www-form-urlencoded request from the AWS Signature Version 4
+	// test suite.
+	body := "Param1=value1"
+	req, err := http.NewRequest("POST", "https://example.amazonaws.com/", strings.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	signAwsRequest(
+		req, body, "us-east-1", "service",
+		awsCredentials{accessKeyId: "AKIDEXAMPLE", secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"},
+		time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC),
+	)
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(
+		t,
+		"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+			"SignedHeaders=content-type;host;x-amz-date, "+
+			"Signature=ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		req.Header.Get("Authorization"),
+	)
+}
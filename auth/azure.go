@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// AzureTokenRetriever is an implementation of JwtTokenRetriever for tokens
+// fetched from Azure managed identities. Tokens are requested from the Azure
+// Instance Metadata Service, or from the App Service and Container Apps
+// identity endpoint when the IDENTITY_ENDPOINT and IDENTITY_HEADER
+// environment variables are set.
+type AzureTokenRetriever struct {
+	metadataHost     string
+	identityEndpoint string
+	identityHeader   string
+	clientId         string
+	objectId         string
+	resourceId       string
+}
+
+// An AzureTokenConfig contains configuration data used to initialize and
+// validate an AzureTokenRetriever object.
+type AzureTokenConfig struct {
+	ClientId     string `long:"client-id" env:"CLIENT_ID" description:"Client ID of a user-assigned managed identity"`
+	ObjectId     string `long:"object-id" env:"OBJECT_ID" description:"Object ID of a user-assigned managed identity"`
+	ResourceId   string `long:"resource-id" env:"RESOURCE_ID" description:"Azure resource ID of a user-assigned managed identity"`
+	MetadataHost string `long:"metadata-host" env:"METADATA_HOST" description:"Azure Instance Metadata Service host" default:"169.254.169.254"`
+}
+
+// azureTokenResponse is the token response returned by the Azure managed
+// identity endpoints.
+type azureTokenResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+// GetToken retrieves a new token for the audience from the managed identity
+// endpoint.
+func (r *AzureTokenRetriever) GetToken(aud string) (string, error) {
+	client := http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	var endpoint string
+	query := url.Values{}
+	query.Set("resource", aud)
+	if r.identityEndpoint != "" {
+		endpoint = r.identityEndpoint
+		query.Set("api-version", "2019-08-01")
+		query = r.identityQuery(query, "principal_id", "mi_res_id")
+	} else {
+		endpoint = fmt.Sprintf("http://%v/metadata/identity/oauth2/token", r.metadataHost)
+		query.Set("api-version", "2018-02-01")
+		query = r.identityQuery(query, "object_id", "msi_res_id")
+	}
+
+	req, err := http.NewRequest("GET", endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating identity request: %w", err)
+	}
+	if r.identityEndpoint != "" {
+		req.Header.Set("X-IDENTITY-HEADER", r.identityHeader)
+	} else {
+		req.Header.Set("Metadata", "true")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("unsuccessful status code while fetching token: %v, %v", resp.StatusCode, string(body))
+	}
+
+	tokenResponse := azureTokenResponse{}
+	err = json.Unmarshal(body, &tokenResponse)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode token response: %w", err)
+	}
+	if tokenResponse.AccessToken == "" {
+		return "", errors.New("token response did not contain an access token")
+	}
+
+	return tokenResponse.AccessToken, nil
+}
+
+// identityQuery adds the user-assigned identity selector to the query. The
+// object ID and resource ID parameter names differ between the endpoints.
+func (r *AzureTokenRetriever) identityQuery(query url.Values, objectIdParam string, resourceIdParam string) url.Values {
+	if r.clientId != "" {
+		query.Set("client_id", r.clientId)
+	}
+	if r.objectId != "" {
+		query.Set(objectIdParam, r.objectId)
+	}
+	if r.resourceId != "" {
+		query.Set(resourceIdParam, r.resourceId)
+	}
+	return query
+}
+
+// Configure will take a valid AzureTokenConfig and use it to configure the token retriever.
+func (r *AzureTokenRetriever) Configure(config interface{}) error {
+	c, ok := config.(*AzureTokenConfig)
+	if !ok {
+		log.Fatalln("internal error: incorrect token config")
+	}
+
+	selectors := 0
+	for _, v := range []string{c.ClientId, c.ObjectId, c.ResourceId} {
+		if v != "" {
+			selectors++
+		}
+	}
+	if selectors > 1 {
+		return errors.New("only one of client ID, object ID, or resource ID may be specified")
+	}
+
+	r.identityEndpoint = os.Getenv("IDENTITY_ENDPOINT")
+	r.identityHeader = os.Getenv("IDENTITY_HEADER")
+	if r.identityEndpoint != "" && r.identityHeader == "" {
+		return errors.New("IDENTITY_HEADER must be set when IDENTITY_ENDPOINT is set")
+	}
+	if r.identityEndpoint == "" && c.MetadataHost == "" {
+		return errors.New("Azure metadata host must not be empty")
+	}
+
+	r.metadataHost = c.MetadataHost
+	r.clientId = c.ClientId
+	r.objectId = c.ObjectId
+	r.resourceId = c.ResourceId
+	return nil
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAzureTokenRetriever_Imds(t *testing.T) {
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(rw http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/metadata/identity/oauth2/token", r.URL.Path)
+				assert.Equal(t, "true", r.Header.Get("Metadata"))
+				assert.Equal(t, "2018-02-01", r.URL.Query().Get("api-version"))
+				assert.Equal(t, "test-client", r.URL.Query().Get("client_id"))
+
+				aud := r.URL.Query().Get("resource")
+				_ = json.NewEncoder(rw).Encode(azureTokenResponse{AccessToken: newTestToken(t, aud, "test-identity")})
+			},
+		),
+	)
+	defer server.Close()
+
+	retriever := new(AzureTokenRetriever)
+	err := retriever.Configure(
+		&AzureTokenConfig{
+			ClientId:     "test-client",
+			MetadataHost: strings.TrimPrefix(server.URL, "http://"),
+		},
+	)
+	assert.NoError(t, err)
+
+	token, err := retriever.GetToken("api://test-svc")
+	assert.NoError(t, err)
+	assert.NoError(t, checkTokenAudience(token, "api://test-svc"))
+}
+
+func TestAzureTokenRetriever_IdentityEndpoint(t *testing.T) {
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(rw http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "2019-08-01", r.URL.Query().Get("api-version"))
+				assert.Equal(t, "test-object", r.URL.Query().Get("principal_id"))
+				if r.Header.Get("X-IDENTITY-HEADER") != "test-secret" {
+					rw.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+
+				aud := r.URL.Query().Get("resource")
+				_ = json.NewEncoder(rw).Encode(azureTokenResponse{AccessToken: newTestToken(t, aud, "test-identity")})
+			},
+		),
+	)
+	defer server.Close()
+
+	t.Setenv("IDENTITY_ENDPOINT", server.URL+"/msi/token")
+	t.Setenv("IDENTITY_HEADER", "test-secret")
+
+	retriever := new(AzureTokenRetriever)
+	err := retriever.Configure(&AzureTokenConfig{ObjectId: "test-object"})
+	assert.NoError(t, err)
+
+	token, err := retriever.GetToken("api://test-svc")
+	assert.NoError(t, err)
+	assert.NoError(t, checkTokenAudience(token, "api://test-svc"))
+
+	err = retriever.Configure(&AzureTokenConfig{ClientId: "test-client", ObjectId: "test-object"})
+	assert.Error(t, err)
+}
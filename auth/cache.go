@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A tokenFileCache persists tokens to a file encrypted with AES-GCM, so that
+// tokens can be reused after the process restarts. The file is replaced
+// atomically on each write. The file records a fingerprint of the auth
+// configuration that issued the tokens, and tokens issued with a different
+// configuration are not loaded.
+type tokenFileCache struct {
+	path        string
+	fingerprint string
+	aead        cipher.AEAD
+}
+
+// tokenCacheFile is the decrypted contents of a tokenFileCache file.
+type tokenCacheFile struct {
+	Fingerprint string                    `json:"fingerprint"`
+	Tokens      map[string]persistedToken `json:"tokens"`
+}
+
+// A persistedToken is a token for an audience stored in a tokenFileCache.
+type persistedToken struct {
+	Audience  string    `json:"audience,omitempty"`
+	Token     string    `json:"token"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// newTokenFileCache returns a tokenFileCache for the file at path. The
+// encryption key is derived from key using SHA-256.
+func newTokenFileCache(path string, key []byte, fingerprint string) (*tokenFileCache, error) {
+	if len(key) == 0 {
+		return nil, errors.New("token cache key must not be empty")
+	}
+
+	derivedKey := sha256.Sum256(key)
+	block, err := aes.NewCipher(derivedKey[:])
+	if err != nil {
+		return nil, fmt.Errorf("unable to create token cache cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create token cache cipher: %w", err)
+	}
+
+	return &tokenFileCache{
+		path:        path,
+		fingerprint: fingerprint,
+		aead:        aead,
+	}, nil
+}
+
+// load reads the tokens from the cache file. An error is returned if the
+// tokens were saved with a different fingerprint.
+func (c *tokenFileCache) load() (map[string]persistedToken, error) {
+	b, err := os.ReadFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := c.aead.NonceSize()
+	if len(b) < nonceSize {
+		return nil, errors.New("token cache file is truncated")
+	}
+	plaintext, err := c.aead.Open(nil, b[:nonceSize], b[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt token cache: %w", err)
+	}
+
+	file := tokenCacheFile{}
+	err = json.Unmarshal(plaintext, &file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode token cache: %w", err)
+	}
+	if file.Fingerprint != c.fingerprint {
+		return nil, errors.New("token cache was written with a different auth configuration")
+	}
+
+	return file.Tokens, nil
+}
+
+// save replaces the cache file with the tokens. The file is written to a
+// temporary file in the same directory and renamed, so that a reader never
+// observes a partially written cache.
+func (c *tokenFileCache) save(tokens map[string]persistedToken) error {
+	plaintext, err := json.Marshal(tokenCacheFile{Fingerprint: c.fingerprint, Tokens: tokens})
+	if err != nil {
+		return fmt.Errorf("unable to encode token cache: %w", err)
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return fmt.Errorf("unable to generate token cache nonce: %w", err)
+	}
+	b := c.aead.Seal(nonce, nonce, plaintext, nil)
+
+	f, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("unable to create token cache file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write token cache file: %w", err)
+	}
+
+	err = os.Rename(f.Name(), c.path)
+	if err != nil {
+		return fmt.Errorf("unable to replace token cache file: %w", err)
+	}
+
+	return nil
+}
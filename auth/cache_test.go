@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenFileCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	cache, err := newTokenFileCache(path, []byte("test-key"), "test-config")
+	assert.NoError(t, err)
+
+	_, err = cache.load()
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	now := time.Now().Truncate(time.Second)
+	tokens := map[string]persistedToken{
+		"test-svc": {Token: "test-token", IssuedAt: now, ExpiresAt: now.Add(time.Hour)},
+	}
+	assert.NoError(t, cache.save(tokens))
+
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "test-token")
+
+	loaded, err := cache.load()
+	assert.NoError(t, err)
+	assert.Equal(t, "test-token", loaded["test-svc"].Token)
+	assert.True(t, now.Add(time.Hour).Equal(loaded["test-svc"].ExpiresAt))
+
+	// A cache written with a different key can not be read.
+	other, err := newTokenFileCache(path, []byte("other-key"), "test-config")
+	assert.NoError(t, err)
+	_, err = other.load()
+	assert.Error(t, err)
+
+	// A cache written for a different auth configuration is not loaded.
+	other, err = newTokenFileCache(path, []byte("test-key"), "other-config")
+	assert.NoError(t, err)
+	_, err = other.load()
+	assert.ErrorContains(t, err, "different auth configuration")
+
+	_, err = newTokenFileCache(path, nil, "test-config")
+	assert.Error(t, err)
+}
+
+func TestJwtManager_Cache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	retriever := &countingTokenRetriever{t: t, calls: map[string]int{}}
+
+	manager := NewJwtManager(retriever)
+	assert.NoError(t, manager.SetCache(path, []byte("test-key"), "test-config"))
+	first, err := manager.Token("test-svc")
+	assert.NoError(t, err)
+
+	// A new JwtManager, such as after a restart, reuses the cached token.
+	manager = NewJwtManager(retriever)
+	assert.NoError(t, manager.SetCache(path, []byte("test-key"), "test-config"))
+	second, err := manager.Token("test-svc")
+	assert.NoError(t, err)
+	assert.Equal(t, first, second)
+	assert.Equal(t, 1, retriever.callCounts()["test-svc"])
+
+	// Tokens cached for a different auth configuration are discarded.
+	other := NewJwtManager(retriever)
+	assert.NoError(t, other.SetCache(path, []byte("test-key"), "other-config"))
+	assert.Empty(t, other.Status())
+
+	// Invalidated tokens are removed from the cache.
+	assert.True(t, manager.Invalidate("test-svc", second))
+	manager = NewJwtManager(retriever)
+	assert.NoError(t, manager.SetCache(path, []byte("test-key"), "test-config"))
+	assert.Empty(t, manager.Status())
+
+	// A corrupt cache is ignored and replaced.
+	assert.NoError(t, os.WriteFile(path, []byte("corrupt"), 0600))
+	manager = NewJwtManager(retriever)
+	assert.NoError(t, manager.SetCache(path, []byte("test-key"), "test-config"))
+	_, err = manager.Token("test-svc")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, retriever.callCounts()["test-svc"])
+
+	cache, err := newTokenFileCache(path, []byte("test-key"), "test-config")
+	assert.NoError(t, err)
+	loaded, err := cache.load()
+	assert.NoError(t, err)
+	assert.Contains(t, loaded, "test-svc")
+}
@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ChainTokenRetriever is an implementation of JwtTokenRetriever that tries an
+// ordered list of JwtTokenRetriever implementations, and returns the token
+// from the first that succeeds. A retriever that fails repeatedly is skipped
+// until its circuit breaker closes again.
+type ChainTokenRetriever struct {
+	sources          []*chainSource
+	failureThreshold int
+	openDuration     time.Duration
+}
+
+// A ChainTokenConfig contains configuration data used to initialize and
+// validate a ChainTokenRetriever object. The Retrievers must be configured
+// before the ChainTokenRetriever, and Names contains the auth type of each.
+type ChainTokenConfig struct {
+	FailureThreshold int                 `long:"failure-threshold" env:"FAILURE_THRESHOLD" description:"Number of consecutive failures after which an auth type is skipped" default:"3"`
+	OpenDuration     time.Duration       `long:"open-duration" env:"OPEN_DURATION" description:"Duration for which a failing auth type is skipped" default:"30s"`
+	Names            []string            `no-flag:"true"`
+	Retrievers       []JwtTokenRetriever `no-flag:"true"`
+}
+
+// A chainSource is a JwtTokenRetriever in a chain, along with the state of
+// its circuit breaker.
+type chainSource struct {
+	name      string
+	retriever JwtTokenRetriever
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// GetToken returns a token from the first retriever in the chain that
+// succeeds.
+func (r *ChainTokenRetriever) GetToken(aud string) (string, error) {
+	return r.firstToken(
+		aud, func(retriever JwtTokenRetriever) (string, error) {
+			return retriever.GetToken(aud)
+		},
+	)
+}
+
+// RequestClaims resolves the request claims of each retriever in the chain
+// that includes claims from the incoming request.
+func (r *ChainTokenRetriever) RequestClaims(req *http.Request) (map[string]interface{}, error) {
+	var claims map[string]interface{}
+	for _, s := range r.sources {
+		retriever, ok := s.retriever.(RequestTokenRetriever)
+		if !ok {
+			continue
+		}
+		sourceClaims, err := retriever.RequestClaims(req)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", s.name, err)
+		}
+		for k, v := range sourceClaims {
+			if claims == nil {
+				claims = make(map[string]interface{})
+			}
+			claims[k] = v
+		}
+	}
+	return claims, nil
+}
+
+// GetTokenWithClaims returns a token from the first retriever in the chain
+// that succeeds, passing the request claims to retrievers that include them.
+func (r *ChainTokenRetriever) GetTokenWithClaims(aud string, claims map[string]interface{}) (string, error) {
+	return r.firstToken(
+		aud, func(retriever JwtTokenRetriever) (string, error) {
+			if rr, ok := retriever.(RequestTokenRetriever); ok {
+				return rr.GetTokenWithClaims(aud, claims)
+			}
+			return retriever.GetToken(aud)
+		},
+	)
+}
+
+// Retrievers returns the retrievers in the chain, in order.
+func (r *ChainTokenRetriever) Retrievers() []JwtTokenRetriever {
+	retrievers := make([]JwtTokenRetriever, len(r.sources))
+	for i, s := range r.sources {
+		retrievers[i] = s.retriever
+	}
+	return retrievers
+}
+
+// firstToken calls getToken for each retriever in the chain whose circuit
+// breaker is closed, and returns the first token.
+func (r *ChainTokenRetriever) firstToken(aud string, getToken func(JwtTokenRetriever) (string, error)) (string, error) {
+	var errs []error
+	for _, s := range r.sources {
+		if s.open() {
+			errs = append(errs, fmt.Errorf("%v: skipped after repeated failures", s.name))
+			continue
+		}
+
+		token, err := getToken(s.retriever)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", s.name, err))
+			if s.fail(r.failureThreshold, r.openDuration) {
+				log.Printf("skipping auth type %v for %v after repeated failures: %v\n", s.name, r.openDuration, err)
+			}
+			continue
+		}
+
+		s.succeed()
+		log.Printf("token for audience %v issued by auth type %v\n", aud, s.name)
+		return token, nil
+	}
+
+	return "", fmt.Errorf("no auth type issued a token: %w", errors.Join(errs...))
+}
+
+// tokenExpiration returns the expiration reported by the retriever in the
+// chain that issued the token, if any.
+func (r *ChainTokenRetriever) tokenExpiration(token string) (time.Time, bool) {
+	for _, s := range r.sources {
+		if e, ok := s.retriever.(expiringTokenRetriever); ok {
+			if exp, ok := e.tokenExpiration(token); ok {
+				return exp, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// Configure will take a valid ChainTokenConfig and use it to configure the token retriever.
+func (r *ChainTokenRetriever) Configure(config interface{}) error {
+	c, ok := config.(*ChainTokenConfig)
+	if !ok {
+		log.Fatalln("internal error: incorrect token config")
+	}
+	if len(c.Retrievers) == 0 {
+		return errors.New("at least one auth type must be configured")
+	}
+	if len(c.Names) != len(c.Retrievers) {
+		log.Fatalln("internal error: each auth type in the chain must be named")
+	}
+	if c.FailureThreshold <= 0 {
+		return errors.New("failure threshold must be positive")
+	}
+	if c.OpenDuration < 0 {
+		return errors.New("open duration must not be negative")
+	}
+
+	r.sources = nil
+	for i, retriever := range c.Retrievers {
+		r.sources = append(
+			r.sources, &chainSource{
+				name:      c.Names[i],
+				retriever: retriever,
+			},
+		)
+	}
+	r.failureThreshold = c.FailureThreshold
+	r.openDuration = c.OpenDuration
+	return nil
+}
+
+// open returns true if the circuit breaker is open and the source should be
+// skipped.
+func (s *chainSource) open() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Now().Before(s.openUntil)
+}
+
+// fail records a failure, and returns true if the circuit breaker opened.
+func (s *chainSource) fail(threshold int, openDuration time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures++
+	if s.failures < threshold {
+		return false
+	}
+	s.failures = 0
+	s.openUntil = time.Now().Add(openDuration)
+	return true
+}
+
+// succeed resets the circuit breaker.
+func (s *chainSource) succeed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = 0
+	s.openUntil = time.Time{}
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// toggleTokenRetriever returns test tokens, or an error while it is failing.
+type toggleTokenRetriever struct {
+	t       *testing.T
+	sub     string
+	failing atomic.Bool
+	calls   atomic.Int32
+}
+
+func (r *toggleTokenRetriever) GetToken(aud string) (string, error) {
+	r.calls.Add(1)
+	if r.failing.Load() {
+		return "", errors.New("test failure")
+	}
+	return newTestToken(r.t, aud, r.sub), nil
+}
+
+func (r *toggleTokenRetriever) Configure(_ interface{}) error {
+	return nil
+}
+
+// claimsTokenRetriever is a toggleTokenRetriever that resolves the subject
+// from a request header.
+type claimsTokenRetriever struct {
+	toggleTokenRetriever
+}
+
+func (r *claimsTokenRetriever) RequestClaims(req *http.Request) (map[string]interface{}, error) {
+	return map[string]interface{}{"sub": req.Header.Get("X-Subject")}, nil
+}
+
+func (r *claimsTokenRetriever) GetTokenWithClaims(aud string, claims map[string]interface{}) (string, error) {
+	if r.failing.Load() {
+		return "", errors.New("test failure")
+	}
+	return newTestToken(r.t, aud, claims["sub"].(string)), nil
+}
+
+func TestChainTokenRetriever(t *testing.T) {
+	primary := &toggleTokenRetriever{t: t, sub: "primary"}
+	secondary := &toggleTokenRetriever{t: t, sub: "secondary"}
+
+	retriever := new(ChainTokenRetriever)
+	err := retriever.Configure(
+		&ChainTokenConfig{
+			FailureThreshold: 2,
+			OpenDuration:     100 * time.Millisecond,
+			Names:            []string{"primary", "secondary"},
+			Retrievers:       []JwtTokenRetriever{primary, secondary},
+		},
+	)
+	assert.NoError(t, err)
+
+	subject := func() string {
+		token, err := retriever.GetToken("test-svc")
+		assert.NoError(t, err)
+		claims := jwt.MapClaims{}
+		_, _, err = jwt.NewParser().ParseUnverified(token, claims)
+		assert.NoError(t, err)
+		return claims["sub"].(string)
+	}
+
+	assert.Equal(t, "primary", subject())
+	assert.Equal(t, int32(0), secondary.calls.Load())
+
+	// Failures fall back to the next retriever, and the failing retriever is
+	// skipped once its circuit breaker opens.
+	primary.failing.Store(true)
+	assert.Equal(t, "secondary", subject())
+	assert.Equal(t, "secondary", subject())
+	assert.Equal(t, "secondary", subject())
+	assert.Equal(t, int32(3), primary.calls.Load())
+
+	// After the open duration, the retriever is tried again.
+	primary.failing.Store(false)
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, "primary", subject())
+
+	primary.failing.Store(true)
+	secondary.failing.Store(true)
+	_, err = retriever.GetToken("test-svc")
+	assert.ErrorContains(t, err, "primary: test failure")
+	assert.ErrorContains(t, err, "secondary: test failure")
+
+	err = retriever.Configure(&ChainTokenConfig{FailureThreshold: 1})
+	assert.Error(t, err)
+}
+
+func TestChainTokenRetriever_RequestClaims(t *testing.T) {
+	primary := &toggleTokenRetriever{t: t, sub: "primary"}
+	secondary := &claimsTokenRetriever{toggleTokenRetriever{t: t, sub: "secondary"}}
+
+	retriever := new(ChainTokenRetriever)
+	err := retriever.Configure(
+		&ChainTokenConfig{
+			FailureThreshold: 2,
+			OpenDuration:     time.Minute,
+			Names:            []string{"primary", "secondary"},
+			Retrievers:       []JwtTokenRetriever{primary, secondary},
+		},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, []JwtTokenRetriever{primary, secondary}, retriever.Retrievers())
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Subject", "from-request")
+	claims, err := retriever.RequestClaims(req)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"sub": "from-request"}, claims)
+
+	subject := func() string {
+		token, err := retriever.GetTokenWithClaims("test-svc", claims)
+		assert.NoError(t, err)
+		tokenClaims := jwt.MapClaims{}
+		_, _, err = jwt.NewParser().ParseUnverified(token, tokenClaims)
+		assert.NoError(t, err)
+		return tokenClaims["sub"].(string)
+	}
+
+	// Retrievers without request claims are still used in order.
+	assert.Equal(t, "primary", subject())
+	primary.failing.Store(true)
+	assert.Equal(t, "from-request", subject())
+}
@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// GithubActionsTokenRetriever is an implementation of JwtTokenRetriever for
+// OIDC identity tokens requested from the GitHub Actions ID token endpoint.
+type GithubActionsTokenRetriever struct {
+	requestUrl   string
+	requestToken string
+}
+
+// A GithubActionsTokenConfig contains configuration data used to initialize
+// and validate a GithubActionsTokenRetriever object.
+type GithubActionsTokenConfig struct {
+	RequestUrl   string `long:"request-url" env:"REQUEST_URL" description:"ID token request URL (defaults to ACTIONS_ID_TOKEN_REQUEST_URL)"`
+	RequestToken string `long:"request-token" env:"REQUEST_TOKEN" description:"ID token request bearer token (defaults to ACTIONS_ID_TOKEN_REQUEST_TOKEN)"`
+}
+
+// GitlabCiTokenRetriever is an implementation of JwtTokenRetriever for
+// GitLab CI ID tokens, which are provided to jobs as environment variables.
+type GitlabCiTokenRetriever struct {
+	variables []string
+}
+
+// A GitlabCiTokenConfig contains configuration data used to initialize and
+// validate a GitlabCiTokenRetriever object.
+type GitlabCiTokenConfig struct {
+	TokenVariables []string `long:"token-variable" env:"TOKEN_VARIABLES" env-delim:"," description:"Environment variables containing ID tokens" default:"CI_JOB_JWT_V2"`
+}
+
+// githubActionsTokenResponse is the response from the GitHub Actions ID
+// token endpoint.
+type githubActionsTokenResponse struct {
+	Value string `json:"value"`
+}
+
+// GetToken requests a new ID token for the audience from GitHub Actions.
+func (r *GithubActionsTokenRetriever) GetToken(aud string) (string, error) {
+	client := http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	u, err := url.Parse(r.requestUrl)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse ID token request URL: %w", err)
+	}
+	query := u.Query()
+	query.Set("audience", aud)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating identity request: %w", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", r.requestToken))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("unsuccessful status code while fetching token: %v, %v", resp.StatusCode, string(body))
+	}
+
+	tokenResponse := githubActionsTokenResponse{}
+	err = json.Unmarshal(body, &tokenResponse)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode token response: %w", err)
+	}
+	if tokenResponse.Value == "" {
+		return "", errors.New("token response did not contain a token")
+	}
+
+	return tokenResponse.Value, nil
+}
+
+// Configure will take a valid GithubActionsTokenConfig and use it to configure the token retriever.
+func (r *GithubActionsTokenRetriever) Configure(config interface{}) error {
+	c, ok := config.(*GithubActionsTokenConfig)
+	if !ok {
+		log.Fatalln("internal error: incorrect token config")
+	}
+
+	r.requestUrl = c.RequestUrl
+	if r.requestUrl == "" {
+		r.requestUrl = os.Getenv("ACTIONS_ID_TOKEN_REQUEST_URL")
+	}
+	r.requestToken = c.RequestToken
+	if r.requestToken == "" {
+		r.requestToken = os.Getenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN")
+	}
+
+	if r.requestUrl == "" || r.requestToken == "" {
+		return unavailable(
+			errors.New("GitHub Actions ID token request URL and token are required, check the job has id-token: write permission"),
+		)
+	}
+	return nil
+}
+
+// GetToken returns the first ID token from the configured environment
+// variables that was issued for the audience.
+func (r *GitlabCiTokenRetriever) GetToken(aud string) (string, error) {
+	for _, v := range r.variables {
+		token := strings.TrimSpace(os.Getenv(v))
+		if token == "" {
+			continue
+		}
+		if checkTokenAudience(token, aud) == nil {
+			return token, nil
+		}
+	}
+
+	return "", fmt.Errorf("no ID token for audience %v was found in %v", aud, strings.Join(r.variables, ", "))
+}
+
+// Configure will take a valid GitlabCiTokenConfig and use it to configure the token retriever.
+func (r *GitlabCiTokenRetriever) Configure(config interface{}) error {
+	c, ok := config.(*GitlabCiTokenConfig)
+	if !ok {
+		log.Fatalln("internal error: incorrect token config")
+	}
+	if len(c.TokenVariables) == 0 {
+		return errors.New("at least one token variable must be specified")
+	}
+	if !slices.ContainsFunc(c.TokenVariables, func(v string) bool { return os.Getenv(v) != "" }) {
+		return unavailable(fmt.Errorf("none of the token variables are set: %v", strings.Join(c.TokenVariables, ", ")))
+	}
+
+	r.variables = c.TokenVariables
+	return nil
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGithubActionsTokenRetriever(t *testing.T) {
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(rw http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer test-request-token" {
+					rw.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				assert.Equal(t, "2.0", r.URL.Query().Get("api-version"))
+
+				aud := r.URL.Query().Get("audience")
+				_ = json.NewEncoder(rw).Encode(githubActionsTokenResponse{Value: newTestToken(t, aud, "repo:test/test")})
+			},
+		),
+	)
+	defer server.Close()
+
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_URL", server.URL+"/token?api-version=2.0")
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN", "test-request-token")
+
+	retriever := new(GithubActionsTokenRetriever)
+	err := retriever.Configure(&GithubActionsTokenConfig{})
+	assert.NoError(t, err)
+
+	token, err := retriever.GetToken("test-svc")
+	assert.NoError(t, err)
+	assert.NoError(t, checkTokenAudience(token, "test-svc"))
+
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN", "")
+	err = retriever.Configure(&GithubActionsTokenConfig{})
+	assert.Error(t, err)
+}
+
+func TestGitlabCiTokenRetriever(t *testing.T) {
+	firstToken := newTestToken(t, "first-svc", "project_path:test/test")
+	secondToken := newTestToken(t, "second-svc", "project_path:test/test")
+	t.Setenv("FIRST_ID_TOKEN", firstToken)
+	t.Setenv("SECOND_ID_TOKEN", secondToken)
+
+	retriever := new(GitlabCiTokenRetriever)
+	err := retriever.Configure(
+		&GitlabCiTokenConfig{
+			TokenVariables: []string{"MISSING_ID_TOKEN", "FIRST_ID_TOKEN", "SECOND_ID_TOKEN"},
+		},
+	)
+	assert.NoError(t, err)
+
+	token, err := retriever.GetToken("first-svc")
+	assert.NoError(t, err)
+	assert.Equal(t, firstToken, token)
+
+	token, err = retriever.GetToken("second-svc")
+	assert.NoError(t, err)
+	assert.Equal(t, secondToken, token)
+
+	_, err = retriever.GetToken("other-svc")
+	assert.Error(t, err)
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// oidcDiscoveryPath is the path of the OpenID Connect discovery document
+// relative to the issuer.
+const oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+// defaultIssuerSigningMethod is the signing method accepted when the discovery
+// document does not list any supported signing algorithms. OpenID Connect
+// requires providers to support RS256.
+const defaultIssuerSigningMethod = "RS256"
+
+// An oidcDiscovery contains the fields of an OpenID Connect discovery
+// document used to validate identity tokens.
+type oidcDiscovery struct {
+	Issuer                           string   `json:"issuer"`
+	JwksUri                          string   `json:"jwks_uri"`
+	IdTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// fetchOidcDiscovery fetches the OpenID Connect discovery document of the
+// issuer. As required by OpenID Connect Discovery, the issuer in the document
+// must exactly match the issuer it was fetched from.
+func fetchOidcDiscovery(issuer string) (*oidcDiscovery, error) {
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(issuer, "/") + oidcDiscoveryPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unsuccessful status code while fetching discovery document: %v, %v", resp.StatusCode, resp.Status)
+	}
+
+	discovery := oidcDiscovery{}
+	err = json.NewDecoder(resp.Body).Decode(&discovery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode discovery document: %w", err)
+	}
+	if discovery.Issuer != issuer {
+		return nil, fmt.Errorf("discovery document issuer %v does not match expected issuer %v", discovery.Issuer, issuer)
+	}
+	if discovery.JwksUri == "" {
+		return nil, errors.New("discovery document does not contain a JWKS URI")
+	}
+
+	return &discovery, nil
+}
+
+// NewIssuerKeyManager returns a new JwksKeyManager for the JWKS URL found in
+// the discovery document of the issuer. Tokens must have exactly the issuer
+// in their iss claim, and must be signed with one of the algorithms supported
+// by the issuer, or with RS256 if the issuer does not list any.
+func NewIssuerKeyManager(issuer string, claims *ValidatableMapClaims) (*JwksKeyManager, error) {
+	discovery, err := fetchOidcDiscovery(issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	m := NewJwksKeyManager(discovery.JwksUri, claims)
+	m.issuer = issuer
+	m.validMethods = slices.DeleteFunc(
+		discovery.IdTokenSigningAlgValuesSupported, func(alg string) bool {
+			return alg == "none"
+		},
+	)
+	if len(m.validMethods) == 0 {
+		m.validMethods = []string{defaultIssuerSigningMethod}
+	}
+
+	return m, nil
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewIssuerKeyManager(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	jwk, err := publicJwk(key)
+	assert.NoError(t, err)
+	jwk["kid"] = "test-key"
+	jwk["use"] = "sig"
+
+	var issuer string
+	algs := []string{"RS256"}
+	mux := http.NewServeMux()
+	mux.HandleFunc(
+		"/.well-known/openid-configuration", func(rw http.ResponseWriter, req *http.Request) {
+			_ = json.NewEncoder(rw).Encode(
+				oidcDiscovery{
+					Issuer:                           issuer,
+					JwksUri:                          issuer + "/jwks",
+					IdTokenSigningAlgValuesSupported: algs,
+				},
+			)
+		},
+	)
+	mux.HandleFunc(
+		"/jwks", func(rw http.ResponseWriter, req *http.Request) {
+			_ = json.NewEncoder(rw).Encode(JsonWebKeySet{Keys: []map[string]string{jwk}})
+		},
+	)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	issuer = server.URL
+
+	claims := &ValidatableMapClaims{}
+	claims.AddClaim("aud", "test-svc")
+	manager, err := NewIssuerKeyManager(issuer, claims)
+	assert.NoError(t, err)
+	assert.Equal(t, issuer+"/jwks", manager.url)
+
+	sign := func(method jwt.SigningMethod, iss string) string {
+		token := jwt.NewWithClaims(
+			method, jwt.MapClaims{
+				"iss": iss,
+				"sub": "1234567890",
+				"aud": "test-svc",
+				"exp": time.Now().Add(time.Minute).Unix(),
+				"iat": time.Now().Unix(),
+			},
+		)
+		token.Header["kid"] = "test-key"
+		s, err := token.SignedString(key)
+		assert.NoError(t, err)
+		return s
+	}
+
+	v, err := manager.Validate(sign(jwt.SigningMethodRS256, issuer))
+	assert.True(t, v)
+	assert.NoError(t, err)
+
+	// The issuer must match exactly.
+	v, err = manager.Validate(sign(jwt.SigningMethodRS256, issuer+".evil.example"))
+	assert.False(t, v)
+	assert.ErrorIs(t, err, jwt.ErrTokenInvalidIssuer)
+
+	// The signing method must be supported by the issuer.
+	v, err = manager.Validate(sign(jwt.SigningMethodPS256, issuer))
+	assert.False(t, v)
+	assert.ErrorIs(t, err, jwt.ErrTokenSignatureInvalid)
+
+	// Without any supported algorithms, only RS256 is accepted.
+	algs = []string{"none"}
+	manager, err = NewIssuerKeyManager(issuer, claims)
+	assert.NoError(t, err)
+	v, err = manager.Validate(sign(jwt.SigningMethodRS256, issuer))
+	assert.True(t, v)
+	assert.NoError(t, err)
+	v, err = manager.Validate(sign(jwt.SigningMethodPS256, issuer))
+	assert.False(t, v)
+	assert.ErrorIs(t, err, jwt.ErrTokenSignatureInvalid)
+
+	_, err = NewIssuerKeyManager(issuer+"/", claims)
+	assert.ErrorContains(t, err, "does not match expected issuer")
+
+	_, err = NewIssuerKeyManager(issuer+"/missing", claims)
+	assert.ErrorContains(t, err, "unsuccessful status code while fetching discovery document")
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+)
+
+// ExchangeTokenRetriever is an implementation of JwtTokenRetriever that
+// exchanges a subject token, obtained from another JwtTokenRetriever, for a
+// token with the requested audience using OAuth 2.0 token exchange as
+// described in RFC 8693.
+type ExchangeTokenRetriever struct {
+	subject            JwtTokenRetriever
+	subjectAudience    string
+	subjectTokenType   string
+	requestedTokenType string
+	endpoint           Oauth2TokenRetriever
+}
+
+// An ExchangeTokenConfig contains configuration data used to initialize and
+// validate an ExchangeTokenRetriever object. The Subject retriever must be
+// configured before the ExchangeTokenRetriever.
+type ExchangeTokenConfig struct {
+	TokenUrl           string            `long:"token-url" env:"TOKEN_URL" description:"Security token service endpoint URL"`
+	SubjectAuthType    string            `long:"subject-auth-type" env:"SUBJECT_AUTH_TYPE" description:"Authentication type used to obtain the subject token"`
+	SubjectAudience    string            `long:"subject-audience" env:"SUBJECT_AUDIENCE" description:"Audience of the subject token (defaults to the target audience)"`
+	SubjectTokenType   string            `long:"subject-token-type" env:"SUBJECT_TOKEN_TYPE" description:"Token type identifier of the subject token" default:"urn:ietf:params:oauth:token-type:jwt"`
+	RequestedTokenType string            `long:"requested-token-type" env:"REQUESTED_TOKEN_TYPE" description:"Token type identifier of the requested token"`
+	ClientId           string            `long:"client-id" env:"CLIENT_ID" description:"OAuth 2.0 client ID for the security token service"`
+	ClientSecret       string            `long:"client-secret" env:"CLIENT_SECRET" description:"OAuth 2.0 client secret for the security token service"`
+	Scope              string            `long:"scope" env:"SCOPE" description:"Space separated scopes to request"`
+	Subject            JwtTokenRetriever `no-flag:"true"`
+}
+
+// GetToken obtains a subject token and exchanges it for a token with the
+// audience.
+func (r *ExchangeTokenRetriever) GetToken(aud string) (string, error) {
+	subjectAudience := r.subjectAudience
+	if subjectAudience == "" {
+		subjectAudience = aud
+	}
+	subjectToken, err := r.subject.GetToken(subjectAudience)
+	if err != nil {
+		return "", fmt.Errorf("unable to obtain subject token: %w", err)
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:token-exchange")
+	form.Set("audience", aud)
+	form.Set("subject_token", subjectToken)
+	form.Set("subject_token_type", r.subjectTokenType)
+	if r.requestedTokenType != "" {
+		form.Set("requested_token_type", r.requestedTokenType)
+	}
+	if r.endpoint.scope != "" {
+		form.Set("scope", r.endpoint.scope)
+	}
+	if r.endpoint.authMethod == "" && r.endpoint.clientId != "" {
+		// Public clients identify themselves without authenticating.
+		form.Set("client_id", r.endpoint.clientId)
+	}
+
+	tokenResponse, err := r.endpoint.requestToken(form)
+	if err != nil {
+		return "", fmt.Errorf("token exchange failed: %w", err)
+	}
+
+	return tokenResponse.jwt()
+}
+
+// Configure will take a valid ExchangeTokenConfig and use it to configure the token retriever.
+func (r *ExchangeTokenRetriever) Configure(config interface{}) error {
+	c, ok := config.(*ExchangeTokenConfig)
+	if !ok {
+		log.Fatalln("internal error: incorrect token config")
+	}
+	if c.TokenUrl == "" {
+		return errors.New("token URL must not be empty")
+	}
+	if c.Subject == nil {
+		return errors.New("subject token auth type must be configured")
+	}
+	if c.SubjectTokenType == "" {
+		return errors.New("subject token type must not be empty")
+	}
+	if c.ClientSecret != "" && c.ClientId == "" {
+		return errors.New("client ID must be specified with a client secret")
+	}
+
+	r.subject = c.Subject
+	r.subjectAudience = c.SubjectAudience
+	r.subjectTokenType = c.SubjectTokenType
+	r.requestedTokenType = c.RequestedTokenType
+	r.endpoint = Oauth2TokenRetriever{
+		tokenUrl:     c.TokenUrl,
+		clientId:     c.ClientId,
+		clientSecret: c.ClientSecret,
+		scope:        c.Scope,
+	}
+	if c.ClientSecret != "" {
+		r.endpoint.authMethod = "client_secret_basic"
+	}
+
+	return nil
+}
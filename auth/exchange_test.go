@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExchangeTokenRetriever(t *testing.T) {
+	subjectToken := newTestToken(t, "https://sts.test", "test-workload")
+
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(rw http.ResponseWriter, r *http.Request) {
+				assert.NoError(t, r.ParseForm())
+				assert.Equal(t, "urn:ietf:params:oauth:grant-type:token-exchange", r.PostForm.Get("grant_type"))
+				assert.Equal(t, "urn:ietf:params:oauth:token-type:jwt", r.PostForm.Get("subject_token_type"))
+				clientId, clientSecret, _ := r.BasicAuth()
+				if clientId != "test-client" || clientSecret != "test-secret" {
+					rw.WriteHeader(http.StatusUnauthorized)
+					_ = json.NewEncoder(rw).Encode(oauth2TokenResponse{Error: "invalid_client"})
+					return
+				}
+				if r.PostForm.Get("subject_token") != subjectToken {
+					rw.WriteHeader(http.StatusBadRequest)
+					_ = json.NewEncoder(rw).Encode(oauth2TokenResponse{Error: "invalid_grant"})
+					return
+				}
+
+				_ = json.NewEncoder(rw).Encode(
+					oauth2TokenResponse{
+						AccessToken:     newTestToken(t, r.PostForm.Get("audience"), "test-workload"),
+						IssuedTokenType: "urn:ietf:params:oauth:token-type:jwt",
+					},
+				)
+			},
+		),
+	)
+	defer server.Close()
+
+	subject := new(StaticTokenRetriever)
+	err := subject.Configure(&StaticTokenConfig{Token: subjectToken})
+	assert.NoError(t, err)
+
+	config := &ExchangeTokenConfig{
+		TokenUrl:         server.URL,
+		SubjectAudience:  "https://sts.test",
+		SubjectTokenType: "urn:ietf:params:oauth:token-type:jwt",
+		ClientId:         "test-client",
+		ClientSecret:     "test-secret",
+		Subject:          subject,
+	}
+	retriever := new(ExchangeTokenRetriever)
+	err = retriever.Configure(config)
+	assert.NoError(t, err)
+
+	token, err := retriever.GetToken("test-svc")
+	assert.NoError(t, err)
+	assert.NoError(t, checkTokenAudience(token, "test-svc"))
+
+	config.Subject = nil
+	err = new(ExchangeTokenRetriever).Configure(config)
+	assert.Error(t, err)
+}
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExecTokenRetriever is an implementation of JwtTokenRetriever for tokens
+// returned by an external command. The command may print a raw token, a JSON
+// object with token and expiration fields, or a Kubernetes client-go
+// ExecCredential.
+type ExecTokenRetriever struct {
+	command     string
+	args        []string
+	audienceEnv string
+	timeout     time.Duration
+
+	// expirations holds the expiration reported by the command for each
+	// token that has not expired yet.
+	mu          sync.Mutex
+	expirations map[string]time.Time
+}
+
+// An ExecTokenConfig contains configuration data used to initialize and
+// validate an ExecTokenRetriever object.
+type ExecTokenConfig struct {
+	Command     string        `long:"command" env:"COMMAND" description:"Command that prints an identity token"`
+	Args        []string      `long:"arg" env:"ARGS" env-delim:"," description:"Command argument, {audience} is replaced with the audience"`
+	AudienceEnv string        `long:"audience-env" env:"AUDIENCE_ENV" description:"Environment variable used to pass the audience to the command" default:"OIDC_PROXY_EXEC_AUDIENCE"`
+	Timeout     time.Duration `long:"timeout" env:"TIMEOUT" description:"Timeout for the command to complete" default:"30s"`
+}
+
+// execTokenOutput is the JSON output of a token command. Both the simple
+// token format and the client-go ExecCredential format are supported.
+type execTokenOutput struct {
+	Token      string    `json:"token"`
+	Expiration time.Time `json:"expiration"`
+	Status     *struct {
+		Token               string    `json:"token"`
+		ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+	} `json:"status"`
+}
+
+// GetToken runs the command and returns the token it prints.
+func (r *ExecTokenRetriever) GetToken(aud string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	args := make([]string, len(r.args))
+	for i, a := range r.args {
+		args[i] = strings.ReplaceAll(a, "{audience}", aud)
+	}
+
+	cmd := exec.CommandContext(ctx, r.command, args...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%v=%v", r.audienceEnv, aud))
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("token command failed: %w: %v", err, strings.TrimSpace(stderr.String()))
+	}
+
+	token, expiration, err := parseExecOutput(stdout.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for t, exp := range r.expirations {
+		if !now.Before(exp) {
+			delete(r.expirations, t)
+		}
+	}
+	if !expiration.IsZero() {
+		if r.expirations == nil {
+			r.expirations = make(map[string]time.Time)
+		}
+		r.expirations[token] = expiration
+	}
+
+	return token, nil
+}
+
+// tokenExpiration returns the expiration reported by the command for the
+// token.
+func (r *ExecTokenRetriever) tokenExpiration(token string) (time.Time, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	exp, ok := r.expirations[token]
+	return exp, ok
+}
+
+// Configure will take a valid ExecTokenConfig and use it to configure the token retriever.
+func (r *ExecTokenRetriever) Configure(config interface{}) error {
+	c, ok := config.(*ExecTokenConfig)
+	if !ok {
+		log.Fatalln("internal error: incorrect token config")
+	}
+	if c.Command == "" {
+		return errors.New("command must not be empty")
+	}
+	if c.AudienceEnv == "" {
+		return errors.New("audience environment variable must not be empty")
+	}
+	if c.Timeout <= 0 {
+		return errors.New("timeout must be positive")
+	}
+
+	r.command = c.Command
+	r.args = c.Args
+	r.audienceEnv = c.AudienceEnv
+	r.timeout = c.Timeout
+	return nil
+}
+
+// parseExecOutput returns the token and optional expiration from the output
+// of a token command.
+func parseExecOutput(b []byte) (string, time.Time, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return "", time.Time{}, errors.New("token command did not print a token")
+	}
+
+	if b[0] != '{' {
+		return string(b), time.Time{}, nil
+	}
+
+	output := execTokenOutput{}
+	err := json.Unmarshal(b, &output)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to decode token command output: %w", err)
+	}
+	if output.Status != nil {
+		output.Token = output.Status.Token
+		output.Expiration = output.Status.ExpirationTimestamp
+	}
+	if output.Token == "" {
+		return "", time.Time{}, errors.New("token command output did not contain a token")
+	}
+
+	return output.Token, output.Expiration, nil
+}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTokenScript writes a shell script that prints output, after
+// substituting TOKEN with a token for the audience passed in the environment.
+func writeTokenScript(t *testing.T, output string) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	for _, aud := range []string{"first-svc", "second-svc"} {
+		err := os.WriteFile(filepath.Join(dir, aud), []byte(newTestToken(t, aud, "test-exec")), 0600)
+		assert.NoError(t, err)
+	}
+
+	output = strings.ReplaceAll(output, "TOKEN", `$(cat "`+dir+`/$OIDC_PROXY_EXEC_AUDIENCE")`)
+	script := fmt.Sprintf("#!/bin/sh\necho run >> %v/runs\nprintf '%%s\\n' \"%v\"\n", dir, output)
+	scriptPath := filepath.Join(dir, "token.sh")
+	err := os.WriteFile(scriptPath, []byte(script), 0700)
+	assert.NoError(t, err)
+	return scriptPath, dir
+}
+
+func TestExecTokenRetriever(t *testing.T) {
+	tests := []struct {
+		name       string
+		output     string
+		expiration bool
+	}{
+		{
+			name:   "raw token",
+			output: `TOKEN`,
+		},
+		{
+			name:       "token json",
+			output:     `{\"token\": \"TOKEN\", \"expiration\": \"2099-01-01T00:00:00Z\"}`,
+			expiration: true,
+		},
+		{
+			name:   "exec credential",
+			output: `{\"kind\": \"ExecCredential\", \"apiVersion\": \"client.authentication.k8s.io/v1\", \"status\": {\"token\": \"TOKEN\"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				scriptPath, _ := writeTokenScript(t, tt.output)
+
+				retriever := new(ExecTokenRetriever)
+				err := retriever.Configure(
+					&ExecTokenConfig{
+						Command:     scriptPath,
+						AudienceEnv: "OIDC_PROXY_EXEC_AUDIENCE",
+						Timeout:     10 * time.Second,
+					},
+				)
+				assert.NoError(t, err)
+
+				var tokens []string
+				for _, aud := range []string{"first-svc", "second-svc"} {
+					token, err := retriever.GetToken(aud)
+					assert.NoError(t, err)
+					assert.NoError(t, checkTokenAudience(token, aud))
+					tokens = append(tokens, token)
+				}
+
+				// The expiration of each token is kept, not only the last.
+				for _, token := range tokens {
+					_, ok := retriever.tokenExpiration(token)
+					assert.Equal(t, tt.expiration, ok)
+				}
+			},
+		)
+	}
+}
+
+func TestExecTokenRetriever_Expiration(t *testing.T) {
+	scriptPath, dir := writeTokenScript(t, `{\"token\": \"TOKEN\", \"expiration\": \"2000-01-01T00:00:00Z\"}`)
+
+	retriever := new(ExecTokenRetriever)
+	err := retriever.Configure(
+		&ExecTokenConfig{
+			Command:     scriptPath,
+			AudienceEnv: "OIDC_PROXY_EXEC_AUDIENCE",
+			Timeout:     10 * time.Second,
+		},
+	)
+	assert.NoError(t, err)
+
+	// The reported expiration has passed, so every call must run the command.
+	manager := NewJwtManager(retriever)
+	for i := 0; i < 2; i++ {
+		_, err := manager.Token("first-svc")
+		assert.NoError(t, err)
+	}
+	runs, err := os.ReadFile(filepath.Join(dir, "runs"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(runs), "run"))
+}
+
+func TestExecTokenRetriever_Failure(t *testing.T) {
+	retriever := new(ExecTokenRetriever)
+	err := retriever.Configure(
+		&ExecTokenConfig{
+			Command:     "false",
+			AudienceEnv: "OIDC_PROXY_EXEC_AUDIENCE",
+			Timeout:     10 * time.Second,
+		},
+	)
+	assert.NoError(t, err)
+
+	_, err = retriever.GetToken("first-svc")
+	assert.Error(t, err)
+}
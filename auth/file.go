@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// A fileWatcher periodically reads a file and notifies a callback when the
+// contents have changed. Polling is used rather than filesystem events so that
+// the atomic symlink swaps used by the kubelet for projected and secret
+// volumes are always observed.
+type fileWatcher struct {
+	path     string
+	interval time.Duration
+	read     func(string) ([]byte, error)
+	contents []byte
+	onChange func([]byte)
+	done     chan struct{}
+}
+
+// watchFile reads the file at path, passes the initial contents to onChange
+// and then starts watching the file for changes in the background.
+func watchFile(path string, interval time.Duration, onChange func([]byte)) (*fileWatcher, error) {
+	return watchPath(path, interval, os.ReadFile, onChange)
+}
+
+// watchPath is like watchFile, but uses read to obtain the contents of the
+// path. This allows a directory, or a file that references other files, to be
+// watched as a single unit.
+func watchPath(
+	path string, interval time.Duration, read func(string) ([]byte, error), onChange func([]byte),
+) (*fileWatcher, error) {
+	b, err := read(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file: %w", err)
+	}
+	onChange(b)
+
+	w := &fileWatcher{
+		path:     path,
+		interval: interval,
+		read:     read,
+		contents: b,
+		onChange: onChange,
+		done:     make(chan struct{}),
+	}
+	if interval > 0 {
+		go w.run()
+	}
+
+	return w, nil
+}
+
+// run polls the watched file until the watcher is stopped.
+func (w *fileWatcher) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			b, err := w.read(w.path)
+			if err != nil {
+				log.Printf("unable to read watched file %v: %v\n", w.path, err)
+				continue
+			}
+			if bytes.Equal(b, w.contents) {
+				continue
+			}
+			log.Printf("detected change to watched file %v\n", w.path)
+			w.contents = b
+			w.onChange(b)
+		}
+	}
+}
+
+// Stop ends watching the file. It is safe to call Stop on a nil watcher.
+func (w *fileWatcher) Stop() {
+	if w == nil {
+		return
+	}
+	close(w.done)
+}
+
+// watchSecret passes a secret value to load. If a path is given instead of a
+// value, the contents of the file with surrounding whitespace removed are
+// passed, and the file is watched for changes. An error loading the initial
+// value is returned, while errors loading changes are logged and the previous
+// value is kept. The returned watcher is nil if a path is not given.
+func watchSecret(value string, path string, interval time.Duration, load func([]byte) error) (*fileWatcher, error) {
+	if value != "" && path != "" {
+		return nil, errors.New("only one of a value or a file may be specified")
+	}
+	if path == "" {
+		return nil, load([]byte(value))
+	}
+
+	var initErr error
+	initialized := false
+	watcher, err := watchFile(path, interval, func(b []byte) {
+		err := load(bytes.TrimSpace(b))
+		if !initialized {
+			initialized = true
+			initErr = err
+			return
+		}
+		if err != nil {
+			log.Printf("unable to load changes to %v: %v\n", path, err)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if initErr != nil {
+		watcher.Stop()
+		return nil, initErr
+	}
+
+	return watcher, nil
+}
+
+// WatchSecret passes a secret value to load. If a path is given instead of a
+// value, the contents of the file are passed to load, and passed again
+// whenever the file changes.
+func WatchSecret(value string, path string, interval time.Duration, load func([]byte) error) error {
+	_, err := watchSecret(value, path, interval, load)
+	return err
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchSecret(t *testing.T) {
+	var mu sync.Mutex
+	var loaded string
+	load := func(b []byte) error {
+		if string(b) == "invalid" {
+			return errors.New("invalid secret")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		loaded = string(b)
+		return nil
+	}
+	current := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return loaded
+	}
+
+	watcher, err := watchSecret("inline", "", 10*time.Millisecond, load)
+	assert.NoError(t, err)
+	assert.Nil(t, watcher)
+	assert.Equal(t, "inline", current())
+
+	_, err = watchSecret("invalid", "", 10*time.Millisecond, load)
+	assert.ErrorContains(t, err, "invalid secret")
+
+	// Values that look like paths are used as they are.
+	_, err = watchSecret("@secret", "", 10*time.Millisecond, load)
+	assert.NoError(t, err)
+	assert.Equal(t, "@secret", current())
+
+	secretPath := filepath.Join(t.TempDir(), "secret")
+	err = os.WriteFile(secretPath, []byte("first\n"), 0600)
+	assert.NoError(t, err)
+
+	_, err = watchSecret("inline", secretPath, 10*time.Millisecond, load)
+	assert.ErrorContains(t, err, "only one of a value or a file may be specified")
+
+	watcher, err = watchSecret("", secretPath, 10*time.Millisecond, load)
+	assert.NoError(t, err)
+	defer watcher.Stop()
+
+	// An invalid change is ignored and the previous value is kept.
+	err = os.WriteFile(secretPath, []byte("invalid"), 0600)
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "first", current())
+
+	err = os.WriteFile(secretPath, []byte("second"), 0600)
+	assert.NoError(t, err)
+	assert.Eventually(
+		t, func() bool {
+			return current() == "second"
+		}, time.Second, 10*time.Millisecond,
+	)
+
+	err = os.WriteFile(secretPath, []byte("invalid"), 0600)
+	assert.NoError(t, err)
+	_, err = watchSecret("", secretPath, 10*time.Millisecond, load)
+	assert.ErrorContains(t, err, "invalid secret")
+
+	_, err = watchSecret("", filepath.Join(t.TempDir(), "missing"), 10*time.Millisecond, load)
+	assert.ErrorContains(t, err, "unable to read file")
+}
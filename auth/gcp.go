@@ -1,54 +1,226 @@
 package auth
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
 	"time"
 )
 
 // GcpTokenRetriever is an implementation of JwtTokenRetriever for OIDC
 // identity tokens fetched using the GCP metadata service to obtain instance
-// identity.
+// identity. When a service account to impersonate is configured, the instance
+// identity is instead used to generate ID tokens for that service account with
+// the IAM Credentials API.
 type GcpTokenRetriever struct {
 	serviceAccount string
+	metadataHost   string
+	format         string
+	licenses       bool
+	timeout        time.Duration
+	retries        int
+	retryBackoff   time.Duration
+	impersonate    string
+	delegates      []string
+	includeEmail   bool
+	iamUrl         string
 }
 
 // A GcpTokenConfig contains configuration data used to initialize and
 // validate a GcpTokenRetriever object.
 type GcpTokenConfig struct {
-	ServiceAccount string `long:"service-account" env:"SERVICE_ACCOUNT" description:"GCP instance identity name" default:"default"`
+	ServiceAccount            string        `long:"service-account" env:"SERVICE_ACCOUNT" description:"GCP instance identity name" default:"default"`
+	MetadataHost              string        `long:"metadata-host" env:"METADATA_HOST" description:"GCP metadata server host (defaults to GCE_METADATA_HOST or metadata)"`
+	Format                    string        `long:"format" env:"FORMAT" description:"Format of instance identity tokens" choice:"standard" choice:"full" default:"standard"`
+	Licenses                  bool          `long:"licenses" env:"LICENSES" description:"Include license codes in full format instance identity tokens"`
+	MetadataTimeout           time.Duration `long:"metadata-timeout" env:"METADATA_TIMEOUT" description:"Timeout for each metadata server request" default:"30s"`
+	MetadataRetries           int           `long:"metadata-retries" env:"METADATA_RETRIES" description:"Number of times to retry failed metadata server requests" default:"3"`
+	ImpersonateServiceAccount string        `long:"impersonate-service-account" env:"IMPERSONATE_SERVICE_ACCOUNT" description:"Email of a service account to generate ID tokens for"`
+	Delegates                 []string      `long:"delegate" env:"DELEGATES" env-delim:"," description:"Email of a service account in the impersonation delegation chain"`
+	IncludeEmail              bool          `long:"include-email" env:"INCLUDE_EMAIL" description:"Include the email claims in impersonated ID tokens"`
+	IamCredentialsUrl         string        `long:"iam-credentials-url" env:"IAM_CREDENTIALS_URL" description:"IAM Credentials API base URL" default:"https://iamcredentials.googleapis.com"`
 }
 
-// GetToken retrieves a new token from the metadata identity service.
+// gcpAccessTokenResponse is the access token response from the metadata
+// service.
+type gcpAccessTokenResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+// gcpIdTokenRequest is the generateIdToken request of the IAM Credentials API.
+type gcpIdTokenRequest struct {
+	Audience     string   `json:"audience"`
+	Delegates    []string `json:"delegates,omitempty"`
+	IncludeEmail bool     `json:"includeEmail"`
+}
+
+// gcpIdTokenResponse is the generateIdToken response of the IAM Credentials
+// API.
+type gcpIdTokenResponse struct {
+	Token string `json:"token"`
+}
+
+// GetToken retrieves a new token from the metadata identity service, or from
+// the IAM Credentials API when impersonating a service account.
 func (r *GcpTokenRetriever) GetToken(aud string) (string, error) {
+	if r.impersonate != "" {
+		return r.generateIdToken(aud)
+	}
+
+	query := url.Values{}
+	query.Set("audience", aud)
+	if r.format == "full" {
+		query.Set("format", "full")
+		if r.licenses {
+			query.Set("licenses", "TRUE")
+		}
+	}
+
+	body, err := r.metadataRequest("identity", query)
+	if err != nil {
+		return "", err
+	}
+
+	return string(body), nil
+}
+
+// generateIdToken generates an ID token for the impersonated service account
+// using an access token of the instance identity.
+func (r *GcpTokenRetriever) generateIdToken(aud string) (string, error) {
+	body, err := r.metadataRequest("token", nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to obtain access token: %w", err)
+	}
+	accessToken := gcpAccessTokenResponse{}
+	err = json.Unmarshal(body, &accessToken)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode access token response: %w", err)
+	}
+
+	idTokenRequest := gcpIdTokenRequest{
+		Audience:     aud,
+		IncludeEmail: r.includeEmail,
+	}
+	for _, d := range r.delegates {
+		idTokenRequest.Delegates = append(idTokenRequest.Delegates, "projects/-/serviceAccounts/"+d)
+	}
+	reqBody, err := json.Marshal(idTokenRequest)
+	if err != nil {
+		return "", fmt.Errorf("error encoding generateIdToken request: %w", err)
+	}
+
 	client := http.Client{
 		Timeout: 30 * time.Second,
 	}
-	url := fmt.Sprintf("http://metadata/computeMetadata/v1/instance/service-accounts/%v/identity?audience=%v", r.serviceAccount, aud)
-	req, err := http.NewRequest("GET", url, nil)
+	endpoint := fmt.Sprintf("%v/v1/projects/-/serviceAccounts/%v:generateIdToken", r.iamUrl, url.PathEscape(r.impersonate))
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(reqBody))
 	if err != nil {
-		return "", fmt.Errorf("error creating identity request: %w", err)
+		return "", fmt.Errorf("error creating generateIdToken request: %w", err)
 	}
-	req.Header.Set("Metadata-Flavor", "Google")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessToken.AccessToken)
 
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("failed to fetch token: %w", err)
 	}
+	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	body, err = io.ReadAll(resp.Body)
 	if err != nil {
 		return "", err
 	}
 
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("unsuccessful status code while fetching token: %v, %v", resp.StatusCode, body)
+		return "", fmt.Errorf("unsuccessful status code while fetching token: %v, %v", resp.StatusCode, string(body))
 	}
 
-	return string(body), nil
+	idToken := gcpIdTokenResponse{}
+	err = json.Unmarshal(body, &idToken)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode generateIdToken response: %w", err)
+	}
+	if idToken.Token == "" {
+		return "", errors.New("generateIdToken response did not contain a token")
+	}
+
+	return idToken.Token, nil
+}
+
+// metadataRequest fetches a path relative to the configured service account
+// from the metadata service. Requests that fail to connect, time out, have
+// their connection reset, or fail with a server error are retried with
+// exponential backoff.
+func (r *GcpTokenRetriever) metadataRequest(path string, query url.Values) ([]byte, error) {
+	client := http.Client{
+		Timeout: r.timeout,
+	}
+	endpoint := url.URL{
+		Scheme:   "http",
+		Host:     r.metadataHost,
+		Path:     fmt.Sprintf("/computeMetadata/v1/instance/service-accounts/%v/%v", r.serviceAccount, path),
+		RawQuery: query.Encode(),
+	}
+
+	backoff := r.retryBackoff
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		req, err := http.NewRequest("GET", endpoint.String(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("error creating identity request: %w", err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			if retryableMetadataError(err) && attempt < r.retries {
+				continue
+			}
+			return nil, fmt.Errorf("failed to fetch token: %w", err)
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode >= 500 && attempt < r.retries {
+			continue
+		}
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("unsuccessful status code while fetching token: %v, %v", resp.StatusCode, string(body))
+		}
+
+		return body, nil
+	}
+}
+
+// retryableMetadataError reports whether a failed metadata server request may
+// succeed if it is retried.
+func retryableMetadataError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF)
 }
 
 // Configure will take a valid GcpTokenConfig and use it to configure the token retriever.
@@ -60,7 +232,38 @@ func (r *GcpTokenRetriever) Configure(config interface{}) error {
 	if c.ServiceAccount == "" {
 		return errors.New("GCP service account name must not be empty")
 	}
+	if c.ImpersonateServiceAccount == "" && (len(c.Delegates) > 0 || c.IncludeEmail) {
+		return errors.New("delegates and include email require a service account to impersonate")
+	}
+	if c.Licenses && c.Format != "full" {
+		return errors.New("licenses require the full token format")
+	}
+	if c.MetadataTimeout <= 0 {
+		return errors.New("metadata timeout must be positive")
+	}
+	if c.MetadataRetries < 0 {
+		return errors.New("metadata retries must not be negative")
+	}
+	if c.ImpersonateServiceAccount != "" && c.IamCredentialsUrl == "" {
+		return errors.New("IAM Credentials API URL must not be empty")
+	}
 
 	r.serviceAccount = c.ServiceAccount
+	r.metadataHost = c.MetadataHost
+	if r.metadataHost == "" {
+		r.metadataHost = os.Getenv("GCE_METADATA_HOST")
+	}
+	if r.metadataHost == "" {
+		r.metadataHost = "metadata"
+	}
+	r.format = c.Format
+	r.licenses = c.Licenses
+	r.timeout = c.MetadataTimeout
+	r.retries = c.MetadataRetries
+	r.retryBackoff = 100 * time.Millisecond
+	r.impersonate = c.ImpersonateServiceAccount
+	r.delegates = c.Delegates
+	r.includeEmail = c.IncludeEmail
+	r.iamUrl = strings.TrimSuffix(c.IamCredentialsUrl, "/")
 	return nil
 }
@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestMetadataServer returns a stand-in for the GCP metadata service.
+func newTestMetadataServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(
+		http.HandlerFunc(
+			func(rw http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Metadata-Flavor") != "Google" {
+					rw.WriteHeader(http.StatusForbidden)
+					return
+				}
+
+				switch r.URL.Path {
+				case "/computeMetadata/v1/instance/service-accounts/default/identity":
+					_, _ = rw.Write([]byte(newTestToken(t, r.URL.Query().Get("audience"), "instance")))
+				case "/computeMetadata/v1/instance/service-accounts/default/token":
+					_ = json.NewEncoder(rw).Encode(gcpAccessTokenResponse{AccessToken: "test-access-token"})
+				default:
+					rw.WriteHeader(http.StatusNotFound)
+				}
+			},
+		),
+	)
+}
+
+func TestGcpTokenRetriever(t *testing.T) {
+	metadata := newTestMetadataServer(t)
+	defer metadata.Close()
+
+	retriever := new(GcpTokenRetriever)
+	err := retriever.Configure(
+		&GcpTokenConfig{
+			ServiceAccount:  "default",
+			MetadataHost:    strings.TrimPrefix(metadata.URL, "http://"),
+			Format:          "standard",
+			MetadataTimeout: 5 * time.Second,
+		},
+	)
+	assert.NoError(t, err)
+
+	token, err := retriever.GetToken("test-svc")
+	assert.NoError(t, err)
+	assert.NoError(t, checkTokenAudience(token, "test-svc"))
+}
+
+func TestGcpTokenRetriever_Impersonation(t *testing.T) {
+	metadata := newTestMetadataServer(t)
+	defer metadata.Close()
+
+	iam := httptest.NewServer(
+		http.HandlerFunc(
+			func(rw http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/v1/projects/-/serviceAccounts/target@test.iam.gserviceaccount.com:generateIdToken", r.URL.Path)
+				if r.Header.Get("Authorization") != "Bearer test-access-token" {
+					rw.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+
+				idTokenRequest := gcpIdTokenRequest{}
+				err := json.NewDecoder(r.Body).Decode(&idTokenRequest)
+				assert.NoError(t, err)
+				assert.Equal(t, []string{"projects/-/serviceAccounts/delegate@test.iam.gserviceaccount.com"}, idTokenRequest.Delegates)
+				assert.True(t, idTokenRequest.IncludeEmail)
+
+				_ = json.NewEncoder(rw).Encode(
+					gcpIdTokenResponse{Token: newTestToken(t, idTokenRequest.Audience, "target")},
+				)
+			},
+		),
+	)
+	defer iam.Close()
+
+	retriever := new(GcpTokenRetriever)
+	err := retriever.Configure(
+		&GcpTokenConfig{
+			ServiceAccount:            "default",
+			MetadataHost:              strings.TrimPrefix(metadata.URL, "http://"),
+			Format:                    "standard",
+			MetadataTimeout:           5 * time.Second,
+			ImpersonateServiceAccount: "target@test.iam.gserviceaccount.com",
+			Delegates:                 []string{"delegate@test.iam.gserviceaccount.com"},
+			IncludeEmail:              true,
+			IamCredentialsUrl:         iam.URL,
+		},
+	)
+	assert.NoError(t, err)
+
+	token, err := retriever.GetToken("test-svc")
+	assert.NoError(t, err)
+	assert.NoError(t, checkTokenAudience(token, "test-svc"))
+
+	err = retriever.Configure(
+		&GcpTokenConfig{
+			ServiceAccount:  "default",
+			Format:          "standard",
+			MetadataTimeout: 5 * time.Second,
+			Delegates:       []string{"delegate@test.iam.gserviceaccount.com"},
+		},
+	)
+	assert.Error(t, err)
+}
+
+func TestGcpTokenRetriever_FullFormat(t *testing.T) {
+	metadata := httptest.NewServer(
+		http.HandlerFunc(
+			func(rw http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "full", r.URL.Query().Get("format"))
+				assert.Equal(t, "TRUE", r.URL.Query().Get("licenses"))
+				_, _ = rw.Write([]byte(newTestToken(t, r.URL.Query().Get("audience"), "instance")))
+			},
+		),
+	)
+	defer metadata.Close()
+
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(metadata.URL, "http://"))
+
+	retriever := new(GcpTokenRetriever)
+	err := retriever.Configure(
+		&GcpTokenConfig{
+			ServiceAccount:  "default",
+			Format:          "full",
+			Licenses:        true,
+			MetadataTimeout: 5 * time.Second,
+		},
+	)
+	assert.NoError(t, err)
+
+	// The audience must be escaped so that it is not parsed as more parameters.
+	aud := "https://test-svc/?format=standard&x=1"
+	token, err := retriever.GetToken(aud)
+	assert.NoError(t, err)
+	assert.NoError(t, checkTokenAudience(token, aud))
+
+	err = retriever.Configure(
+		&GcpTokenConfig{
+			ServiceAccount:  "default",
+			Format:          "standard",
+			Licenses:        true,
+			MetadataTimeout: 5 * time.Second,
+		},
+	)
+	assert.Error(t, err)
+}
+
+func TestGcpTokenRetriever_Retry(t *testing.T) {
+	var requests atomic.Int32
+	metadata := httptest.NewServer(
+		http.HandlerFunc(
+			func(rw http.ResponseWriter, r *http.Request) {
+				if strings.Contains(r.URL.Path, "/missing/") {
+					requests.Add(1)
+					rw.WriteHeader(http.StatusNotFound)
+					return
+				}
+				switch requests.Add(1) {
+				case 1:
+					rw.WriteHeader(http.StatusServiceUnavailable)
+				case 2:
+					time.Sleep(200 * time.Millisecond)
+				case 3:
+					conn, _, err := rw.(http.Hijacker).Hijack()
+					assert.NoError(t, err)
+					_ = conn.Close()
+				default:
+					_, _ = rw.Write([]byte(newTestToken(t, r.URL.Query().Get("audience"), "instance")))
+				}
+			},
+		),
+	)
+	defer metadata.Close()
+
+	retriever := new(GcpTokenRetriever)
+	err := retriever.Configure(
+		&GcpTokenConfig{
+			ServiceAccount:  "default",
+			MetadataHost:    strings.TrimPrefix(metadata.URL, "http://"),
+			Format:          "standard",
+			MetadataTimeout: 100 * time.Millisecond,
+			MetadataRetries: 3,
+		},
+	)
+	assert.NoError(t, err)
+	retriever.retryBackoff = time.Millisecond
+
+	token, err := retriever.GetToken("test-svc")
+	assert.NoError(t, err)
+	assert.NoError(t, checkTokenAudience(token, "test-svc"))
+	assert.Equal(t, int32(4), requests.Load())
+
+	// Client errors are not retried.
+	retriever.serviceAccount = "missing"
+	_, err = retriever.GetToken("test-svc")
+	assert.Error(t, err)
+	assert.Equal(t, int32(5), requests.Load())
+
+	// Connection failures are retried.
+	metadata.Close()
+	retriever.serviceAccount = "default"
+	_, err = retriever.GetToken("test-svc")
+	assert.Error(t, err)
+	assert.True(t, retryableMetadataError(err))
+}
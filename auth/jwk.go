@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// A JsonWebKeySet is a set of public keys, as described in RFC 7517.
+type JsonWebKeySet struct {
+	Keys []map[string]string `json:"keys"`
+}
+
+// publicJwk returns the required members of the JSON Web Key for the public
+// half of an RSA, EC or Ed25519 key, as described in RFC 7517 and RFC 8037.
+// Private keys are accepted and their public key is used.
+func publicJwk(key interface{}) (map[string]string, error) {
+	if signer, ok := key.(crypto.Signer); ok {
+		key = signer.Public()
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return map[string]string{
+			"kty": "EC",
+			"crv": k.Curve.Params().Name,
+			"x":   base64.RawURLEncoding.EncodeToString(k.X.FillBytes(make([]byte, size))),
+			"y":   base64.RawURLEncoding.EncodeToString(k.Y.FillBytes(make([]byte, size))),
+		}, nil
+	case ed25519.PublicKey:
+		return map[string]string{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"x":   base64.RawURLEncoding.EncodeToString(k),
+		}, nil
+	default:
+		return nil, errors.New("key is not an RSA, EC or Ed25519 key")
+	}
+}
+
+// jwkThumbprint returns the SHA-256 JSON Web Key thumbprint of the public half
+// of a key, as described in RFC 7638.
+func jwkThumbprint(key interface{}) (string, error) {
+	jwk, err := publicJwk(key)
+	if err != nil {
+		return "", err
+	}
+
+	// The thumbprint is computed over the required members in lexicographic
+	// order with no whitespace, which is how maps are encoded as JSON.
+	b, err := json.Marshal(jwk)
+	if err != nil {
+		return "", fmt.Errorf("unable to encode JSON web key: %w", err)
+	}
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
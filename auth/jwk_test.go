@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJwkThumbprint(t *testing.T) {
+	// The example key and thumbprint from RFC 7638, section 3.1.
+	n, err := base64.RawURLEncoding.DecodeString(
+		"0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+	)
+	assert.NoError(t, err)
+	rsaKey := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537}
+
+	thumbprint, err := jwkThumbprint(rsaKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", thumbprint)
+
+	// The example Ed25519 key and thumbprint from RFC 8037, appendix A.3.
+	x, err := base64.RawURLEncoding.DecodeString("11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo")
+	assert.NoError(t, err)
+	thumbprint, err = jwkThumbprint(ed25519.PublicKey(x))
+	assert.NoError(t, err)
+	assert.Equal(t, "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k", thumbprint)
+
+	// Private keys use the thumbprint of their public key.
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	privateThumbprint, err := jwkThumbprint(ecKey)
+	assert.NoError(t, err)
+	publicThumbprint, err := jwkThumbprint(&ecKey.PublicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, publicThumbprint, privateThumbprint)
+
+	_, err = jwkThumbprint([]byte("testing"))
+	assert.Error(t, err)
+}
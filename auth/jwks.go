@@ -14,18 +14,29 @@ import (
 )
 
 // A JwksKeyManager implements the KeyManager interface and supports an
-// auto-refreshed JWKS URL for retrieving keys for JWT validation.
+// auto-refreshed JWKS URL for retrieving keys for JWT validation. If an issuer
+// or valid signing methods are set, tokens must match them exactly.
 type JwksKeyManager struct {
 	url            string
 	jwks           keyfunc.Keyfunc
 	expectedClaims *ValidatableMapClaims
+	issuer         string
+	validMethods   []string
 }
 
 // Validate will parse and validate a JWT token and its claims.
 func (m *JwksKeyManager) Validate(tok string) (bool, error) {
+	var options []jwt.ParserOption
+	if m.issuer != "" {
+		options = append(options, jwt.WithIssuer(m.issuer))
+	}
+	if len(m.validMethods) > 0 {
+		options = append(options, jwt.WithValidMethods(m.validMethods))
+	}
+
 	claims := jwt.MapClaims{}
 	_, err := jwt.ParseWithClaims(
-		tok, &claims, m.jwks.Keyfunc,
+		tok, &claims, m.jwks.Keyfunc, options...,
 	)
 	if err != nil {
 		return false, err
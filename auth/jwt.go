@@ -1,11 +1,17 @@
 package auth
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"net/http"
 	"reflect"
 	"regexp"
 	"slices"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -39,6 +45,39 @@ type JwtTokenRetriever interface {
 	Configure(config interface{}) error
 }
 
+// ErrUnavailable is returned by Configure when an auth type can not be used in
+// the current environment, such as when a platform token file or environment
+// variable does not exist. A chain of auth types leaves out unavailable auth
+// types.
+var ErrUnavailable = errors.New("auth type is not available in this environment")
+
+// unavailable marks an error as caused by the auth type not being available
+// in the current environment.
+func unavailable(err error) error {
+	return fmt.Errorf("%w: %w", ErrUnavailable, err)
+}
+
+// ErrRequestClaims is returned by RequestToken when the claims for the
+// incoming request can not be resolved, such as when a templated claim
+// resolves to an empty value.
+var ErrRequestClaims = errors.New("unable to resolve request claims")
+
+// A RequestTokenRetriever is a JwtTokenRetriever that includes claims
+// resolved from the incoming request in its tokens. The JwtManager caches a
+// token for each distinct set of resolved claims.
+type RequestTokenRetriever interface {
+	JwtTokenRetriever
+	RequestClaims(req *http.Request) (map[string]interface{}, error)
+	GetTokenWithClaims(aud string, claims map[string]interface{}) (string, error)
+}
+
+// An expiringTokenRetriever is a JwtTokenRetriever that learns the
+// expiration of a token separately from its exp claim. The JwtManager renews
+// the token at whichever expiration is earlier.
+type expiringTokenRetriever interface {
+	tokenExpiration(token string) (time.Time, bool)
+}
+
 // A KeyManager is an abstract interface that allows for JWT validation. Each
 // implementation must implement the Validate method to confirm both JWT
 // signature and claims.
@@ -50,62 +89,536 @@ type KeyManager interface {
 	Validate(tok string) (bool, error)
 }
 
+const (
+	// tokenIdleTimeout is the duration after which the JwtManager evicts
+	// cached tokens for audiences that have not been requested.
+	tokenIdleTimeout = 1 * time.Hour
+	// tokenRefreshInterval is the interval at which the JwtManager checks
+	// for cached tokens that should be renewed in the background.
+	tokenRefreshInterval = 1 * time.Second
+	// tokenRetryInterval is the minimum interval between attempts to renew a
+	// token after a failure.
+	tokenRetryInterval = 5 * time.Second
+	// tokenMinRenewInterval is the minimum interval between renewals of a
+	// token. It applies when a renewed token is already due for renewal,
+	// such as a token that was cached by the issuer, or a token with a
+	// lifetime shorter than the renewal skew.
+	tokenMinRenewInterval = 5 * time.Second
+	// defaultRenewFraction is the fraction of a token's lifetime after which
+	// it is renewed.
+	defaultRenewFraction = 0.8
+	// maxRequestClaimTokens is the maximum number of tokens with request
+	// claims held by the JwtManager. The least recently used token is evicted
+	// when a new set of request claims is seen.
+	maxRequestClaimTokens = 1000
+)
+
 // The JwtManager manages JWT retrieval and renewal. It fetches tokens from
-// JwtTokenRetriever implementations.
+// JwtTokenRetriever implementations, and caches a token for each audience and
+// set of request claims.
+// Tokens are renewed before they expire, and a token that could not be
+// renewed continues to be used until it expires. Tokens with request claims
+// are only renewed when they are requested, are not persisted, and are
+// limited in number. A JwtManager is safe for
+// concurrent use, and concurrent requests for a token that must be renewed
+// share a single call to the JwtTokenRetriever.
 type JwtManager struct {
-	token      string
-	renewAfter time.Time
-	method     JwtTokenRetriever
+	mu            sync.Mutex
+	tokens        map[string]*cachedToken
+	refreshing    map[string]*tokenRefresh
+	invalidated   map[string]time.Time
+	idleTimeout   time.Duration
+	maxClaims     int
+	minRenew      time.Duration
+	renewFraction float64
+	renewSkew     time.Duration
+	done          chan struct{}
+	method        JwtTokenRetriever
+
+	// persistMu serializes writes to the token file cache.
+	persistMu sync.Mutex
+	cache     *tokenFileCache
+}
+
+// A tokenRequest identifies a token cached by the JwtManager: the audience,
+// and the claims resolved from the incoming request, if any.
+type tokenRequest struct {
+	aud    string
+	claims map[string]interface{}
+}
+
+// A cachedToken is a token held by the JwtManager for a tokenRequest, along
+// with the state of its renewal. If the initial token could not be fetched,
+// token is empty.
+type cachedToken struct {
+	request     tokenRequest
+	token       string
+	issuedAt    time.Time
+	renewAfter  time.Time
+	expiresAt   time.Time
+	lastUsed    time.Time
+	lastRefresh time.Time
+	lastError   error
+	retryAfter  time.Time
+}
+
+// A tokenRefresh is an in-flight call to the JwtTokenRetriever for a
+// tokenRequest. The token and err fields are set before done is closed.
+type tokenRefresh struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// A TokenStatus describes the renewal state of the token cached for an
+// audience and set of request claims. The values of request claims are not
+// included, and tokens with request claims only report their validity and
+// expiry.
+type TokenStatus struct {
+	Audience      string    `json:"audience"`
+	RequestClaims bool      `json:"request_claims,omitempty"`
+	Valid         bool      `json:"valid"`
+	ExpiresAt     time.Time `json:"expires_at,omitzero"`
+	RenewAfter    time.Time `json:"renew_after,omitzero"`
+	LastRefresh   time.Time `json:"last_refresh,omitzero"`
+	LastError     string    `json:"last_error,omitempty"`
 }
 
 // The ValidatableMapClaims represents JWT claims are used to validate claims
 // presented by a jwt.MapClaims object.
 type ValidatableMapClaims jwt.MapClaims
 
-// Token will fetch JWT tokens from a JwtTokenRetriever. On first use, an
-// initial token will be fetched. On subsequent usage, a new token will be
-// fetched if the token is expiring soon.
+// Token will fetch JWT tokens from a JwtTokenRetriever. On first use of an
+// audience, an initial token will be fetched. On subsequent usage, the cached
+// token is returned while it is valid, and is renewed in the background once
+// it is due for renewal.
 func (m *JwtManager) Token(aud string) (string, error) {
-	if m.token == "" || time.Now().After(m.renewAfter) {
-		ts, err := m.method.GetToken(aud)
-		if err != nil {
-			return "", err
+	return m.RequestToken(aud, nil)
+}
+
+// RequestToken is like Token, but if the JwtTokenRetriever is a
+// RequestTokenRetriever, the token includes claims resolved from the incoming
+// request. The request may be nil.
+func (m *JwtManager) RequestToken(aud string, req *http.Request) (string, error) {
+	r, ok := m.method.(RequestTokenRetriever)
+	if !ok {
+		return m.token(tokenRequest{aud: aud})
+	}
+
+	claims, err := r.RequestClaims(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrRequestClaims, err)
+	}
+
+	return m.token(tokenRequest{aud: aud, claims: claims})
+}
+
+// token returns the cached token for the request, fetching or renewing it as
+// needed.
+func (m *JwtManager) token(request tokenRequest) (string, error) {
+	m.mu.Lock()
+	now := time.Now()
+	m.evictIdle(now)
+
+	cached, ok := m.tokens[request.key()]
+	if ok {
+		cached.lastUsed = now
+	}
+	if ok && cached.token != "" && now.Before(cached.expiresAt) {
+		token := cached.token
+		renew := now.After(cached.renewAfter) && now.After(cached.retryAfter)
+		m.mu.Unlock()
+		if renew {
+			go m.refresh(request)
+		}
+		return token, nil
+	}
+	m.mu.Unlock()
+
+	return m.refresh(request)
+}
+
+// refresh fetches a new token for the request and caches it. If a refresh for
+// the request is already in progress, refresh waits for it and returns its
+// result instead of calling the JwtTokenRetriever again. On failure, the
+// current token is kept and the error is recorded.
+func (m *JwtManager) refresh(request tokenRequest) (string, error) {
+	key := request.key()
+	m.mu.Lock()
+	if call, ok := m.refreshing[key]; ok {
+		m.mu.Unlock()
+		<-call.done
+		return call.token, call.err
+	}
+	call := &tokenRefresh{done: make(chan struct{})}
+	m.refreshing[key] = call
+	m.mu.Unlock()
+
+	ts, issuedAt, expiresAt, err := m.fetchToken(request)
+
+	m.mu.Lock()
+	now := time.Now()
+	cached, ok := m.tokens[key]
+	if !ok {
+		if len(request.claims) > 0 {
+			m.evictRequestClaims()
 		}
+		cached = &cachedToken{request: request, lastUsed: now}
+		m.tokens[key] = cached
+	}
+	if err == nil {
+		cached.token = ts
+		cached.issuedAt = issuedAt
+		cached.renewAfter = m.renewTime(issuedAt, expiresAt)
+		if minRenewAfter := now.Add(m.minRenew); cached.renewAfter.Before(minRenewAfter) {
+			cached.renewAfter = minRenewAfter
+		}
+		cached.expiresAt = expiresAt
+		cached.lastRefresh = now
+		cached.lastError = nil
+		cached.retryAfter = time.Time{}
+	} else {
+		cached.lastError = err
+		cached.retryAfter = now.Add(tokenRetryInterval)
+		if cached.token != "" && now.Before(cached.expiresAt) {
+			log.Printf(
+				"unable to renew token for audience %v, the current token expires at %v: %v\n",
+				request.aud, cached.expiresAt, err,
+			)
+		}
+	}
+	delete(m.refreshing, key)
+	m.mu.Unlock()
+
+	call.token, call.err = ts, err
+	close(call.done)
 
-		parser := new(jwt.Parser)
-		claims := jwt.MapClaims{}
-		_, _, err = parser.ParseUnverified(ts, &claims)
-		if err != nil {
-			return "", fmt.Errorf("unable to parse JWT: %w", err)
+	if err == nil && len(request.claims) == 0 {
+		m.persist()
+	}
+
+	return ts, err
+}
+
+// fetchToken fetches a new token for the request from the JwtTokenRetriever,
+// and returns it with the times at which it was issued and expires.
+func (m *JwtManager) fetchToken(request tokenRequest) (string, time.Time, time.Time, error) {
+	var ts string
+	var err error
+	if len(request.claims) > 0 {
+		r, ok := m.method.(RequestTokenRetriever)
+		if !ok {
+			return "", time.Time{}, time.Time{}, errors.New("auth type does not support request claims")
 		}
+		ts, err = r.GetTokenWithClaims(request.aud, request.claims)
+	} else {
+		ts, err = m.method.GetToken(request.aud)
+	}
+	if err != nil {
+		return "", time.Time{}, time.Time{}, err
+	}
+	if ts == "" {
+		return "", time.Time{}, time.Time{}, errors.New("no token available")
+	}
 
-		oidcClaims, err := validateOidcRequiredClaims(&claims)
-		if oidcClaims {
-			expClaim, ok := claims["exp"].(float64)
-			if !ok {
-				return "", fmt.Errorf("unable to access token expiration")
+	parser := new(jwt.Parser)
+	claims := jwt.MapClaims{}
+	_, _, err = parser.ParseUnverified(ts, &claims)
+	if err != nil {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("unable to parse JWT: %w", err)
+	}
+
+	oidcClaims, err := validateOidcRequiredClaims(&claims)
+	if !oidcClaims {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("unable to get standard JWT Token claims: %w", err)
+	}
+
+	expClaim, ok := claims["exp"].(float64)
+	if !ok {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("unable to access token expiration")
+	}
+	exp := time.Unix(int64(expClaim), 0)
+	if e, ok := m.method.(expiringTokenRetriever); ok {
+		if reported, ok := e.tokenExpiration(ts); ok && reported.Before(exp) {
+			exp = reported
+		}
+	}
+
+	issued := time.Now()
+	if iat, err := claims.GetIssuedAt(); err == nil && iat != nil && iat.Time.Before(exp) {
+		issued = iat.Time
+	}
+
+	return ts, issued, exp, nil
+}
+
+// renewTime returns the time after which a token with the given lifetime
+// should be renewed. The caller must hold m.mu.
+func (m *JwtManager) renewTime(issuedAt time.Time, expiresAt time.Time) time.Time {
+	renewAfter := issuedAt.Add(time.Duration(float64(expiresAt.Sub(issuedAt)) * m.renewFraction))
+	if skewed := expiresAt.Add(-m.renewSkew); skewed.Before(renewAfter) {
+		renewAfter = skewed
+	}
+	return renewAfter
+}
+
+// Invalidate removes the cached token for the audience, but only if the cached
+// entry still holds the given token, so that the next call to Token fetches a
+// new token. This is used when a token is rejected before it expires.
+// Invalidations are limited to one per audience in the minimum renewal
+// interval, so that a target rejecting every token does not cause a new token
+// to be fetched for every request. Invalidate returns true if a token was
+// removed.
+func (m *JwtManager) Invalidate(aud string, token string) bool {
+	m.mu.Lock()
+	now := time.Now()
+	if last, ok := m.invalidated[aud]; ok && now.Before(last.Add(m.minRenew)) {
+		m.mu.Unlock()
+		return false
+	}
+	removed := false
+	for key, cached := range m.tokens {
+		if cached.request.aud == aud && cached.token == token {
+			delete(m.tokens, key)
+			removed = true
+		}
+	}
+	if removed {
+		m.invalidated[aud] = now
+	}
+	m.mu.Unlock()
+
+	if removed {
+		m.persist()
+	}
+	return removed
+}
+
+// SetCache enables persisting tokens to an encrypted file at path, so that
+// tokens are reused after the process restarts. The fingerprint identifies
+// the auth configuration, and valid tokens in an existing file saved with the
+// same fingerprint are loaded into the JwtManager. A file that can not be
+// read or decrypted, or has a different fingerprint, is ignored, and replaced
+// when a token is next fetched.
+func (m *JwtManager) SetCache(path string, key []byte, fingerprint string) error {
+	cache, err := newTokenFileCache(path, key, fingerprint)
+	if err != nil {
+		return err
+	}
+
+	tokens, err := cache.load()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("ignoring token cache %v: %v\n", path, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cache = cache
+	now := time.Now()
+	for key, t := range tokens {
+		if t.Token == "" || !now.Before(t.ExpiresAt) {
+			continue
+		}
+		request := tokenRequest{aud: t.Audience}
+		if request.aud == "" {
+			request.aud = key
+		}
+		m.tokens[request.key()] = &cachedToken{
+			request:    request,
+			token:      t.Token,
+			issuedAt:   t.IssuedAt,
+			renewAfter: m.renewTime(t.IssuedAt, t.ExpiresAt),
+			expiresAt:  t.ExpiresAt,
+			lastUsed:   now,
+		}
+	}
+
+	return nil
+}
+
+// persist writes the valid cached tokens without request claims to the token
+// file cache, if it is enabled.
+func (m *JwtManager) persist() {
+	m.persistMu.Lock()
+	defer m.persistMu.Unlock()
+
+	m.mu.Lock()
+	cache := m.cache
+	now := time.Now()
+	tokens := make(map[string]persistedToken)
+	for key, cached := range m.tokens {
+		if len(cached.request.claims) == 0 && cached.token != "" && now.Before(cached.expiresAt) {
+			tokens[key] = persistedToken{
+				Audience:  cached.request.aud,
+				Token:     cached.token,
+				IssuedAt:  cached.issuedAt,
+				ExpiresAt: cached.expiresAt,
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	if cache == nil {
+		return
+	}
+	err := cache.save(tokens)
+	if err != nil {
+		log.Printf("unable to save token cache: %v\n", err)
+	}
+}
+
+// evictIdle removes cached tokens that have not been requested within the
+// idle timeout, and expired tokens with request claims, which are not renewed
+// in the background. The caller must hold m.mu.
+func (m *JwtManager) evictIdle(now time.Time) {
+	for key, cached := range m.tokens {
+		if now.Sub(cached.lastUsed) > m.idleTimeout {
+			delete(m.tokens, key)
+		} else if len(cached.request.claims) > 0 && !now.Before(cached.expiresAt) {
+			delete(m.tokens, key)
+		}
+	}
+}
+
+// evictRequestClaims removes the least recently used tokens with request
+// claims until there is room for another. The caller must hold m.mu.
+func (m *JwtManager) evictRequestClaims() {
+	for {
+		count := 0
+		var oldest string
+		var oldestUsed time.Time
+		for key, cached := range m.tokens {
+			if len(cached.request.claims) == 0 {
+				continue
+			}
+			count++
+			if oldest == "" || cached.lastUsed.Before(oldestUsed) {
+				oldest, oldestUsed = key, cached.lastUsed
 			}
+		}
+		if count < m.maxClaims {
+			return
+		}
+		delete(m.tokens, oldest)
+	}
+}
+
+// SetRenewal sets when tokens are renewed. A token is renewed after the
+// fraction of its lifetime has passed, or skew before it expires, whichever
+// is earlier.
+func (m *JwtManager) SetRenewal(fraction float64, skew time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.renewFraction = fraction
+	m.renewSkew = skew
+	for _, cached := range m.tokens {
+		if cached.token != "" {
+			cached.renewAfter = m.renewTime(cached.issuedAt, cached.expiresAt)
+		}
+	}
+}
+
+// Start begins renewing cached tokens in the background when they are due for
+// renewal, so that renewal does not delay requests.
+func (m *JwtManager) Start() {
+	m.done = make(chan struct{})
+	go m.run(tokenRefreshInterval)
+}
+
+// Stop ends background renewal of cached tokens. Stop does nothing if Start
+// was not called.
+func (m *JwtManager) Stop() {
+	if m.done != nil {
+		close(m.done)
+	}
+}
+
+// run renews cached tokens without request claims that are due for renewal
+// until the JwtManager is stopped.
+func (m *JwtManager) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.mu.Lock()
 			now := time.Now()
-			exp := time.Unix(int64(expClaim), 0)
-			m.renewAfter = time.Unix(now.Unix()+(exp.Unix()-now.Unix()), 0)
-			m.token = ts
-		} else {
-			return "", fmt.Errorf("unable to get standard JWT Token claims: %w", err)
+			m.evictIdle(now)
+			var due []tokenRequest
+			for _, cached := range m.tokens {
+				if len(cached.request.claims) > 0 {
+					continue
+				}
+				if now.After(cached.renewAfter) && now.After(cached.retryAfter) {
+					due = append(due, cached.request)
+				}
+			}
+			m.mu.Unlock()
+
+			for _, request := range due {
+				go m.refresh(request)
+			}
 		}
 	}
+}
+
+// Status returns the renewal state of each cached token, ordered by audience
+// and request claims.
+func (m *JwtManager) Status() []TokenStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	if m.token == "" {
-		return "", errors.New("no token available")
+	keys := slices.Sorted(maps.Keys(m.tokens))
+	now := time.Now()
+	status := make([]TokenStatus, 0, len(keys))
+	for _, key := range keys {
+		cached := m.tokens[key]
+		s := TokenStatus{
+			Audience:      cached.request.aud,
+			RequestClaims: len(cached.request.claims) > 0,
+			Valid:         cached.token != "" && now.Before(cached.expiresAt),
+			ExpiresAt:     cached.expiresAt,
+		}
+		if !s.RequestClaims {
+			s.RenewAfter = cached.renewAfter
+			s.LastRefresh = cached.lastRefresh
+			if cached.lastError != nil {
+				s.LastError = cached.lastError.Error()
+			}
+		}
+		status = append(status, s)
 	}
 
-	return m.token, nil
+	return status
+}
+
+// key returns the key of the request in the token cache. Requests without
+// request claims are cached by audience.
+func (t tokenRequest) key() string {
+	if len(t.claims) == 0 {
+		return t.aud
+	}
+	// Maps are encoded with sorted keys, so equal claims have equal keys.
+	b, _ := json.Marshal(t.claims)
+	return t.aud + " " + string(b)
 }
 
 // NewJwtManager returns a new JwtManager with the supplied JwtTokenRetriever
 // implementation.
-func NewJwtManager(method JwtTokenRetriever) JwtManager {
-	return JwtManager{
-		method: method,
+func NewJwtManager(method JwtTokenRetriever) *JwtManager {
+	return &JwtManager{
+		tokens:        make(map[string]*cachedToken),
+		refreshing:    make(map[string]*tokenRefresh),
+		invalidated:   make(map[string]time.Time),
+		idleTimeout:   tokenIdleTimeout,
+		maxClaims:     maxRequestClaimTokens,
+		minRenew:      tokenMinRenewInterval,
+		renewFraction: defaultRenewFraction,
+		method:        method,
 	}
 }
 
@@ -122,6 +635,12 @@ func (c ValidatableMapClaims) ValidateClaims(requestClaims *jwt.MapClaims) (bool
 		return false, errors.New("internal error: audience claim was missing from expected claims")
 	}
 
+	return c.matchClaims(requestClaims)
+}
+
+// matchClaims confirms that the jwt.MapClaims match each of the expected
+// claims, without checking for the presence of required OIDC claims.
+func (c ValidatableMapClaims) matchClaims(requestClaims *jwt.MapClaims) (bool, error) {
 	for k, v := range c {
 		cv, ok := (*requestClaims)[k]
 		if !ok {
@@ -169,7 +688,7 @@ func (c ValidatableMapClaims) ValidateClaims(requestClaims *jwt.MapClaims) (bool
 			if reflect.TypeOf(cv) != reflect.TypeOf(v) {
 				return false, fmt.Errorf("claim did not match expected type: %v", k)
 			}
-			if cv != v {
+			if !reflect.DeepEqual(cv, v) {
 				return false, fmt.Errorf("claim did not match expected value: %v", k)
 			}
 		}
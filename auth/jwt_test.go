@@ -1,7 +1,12 @@
 package auth
 
 import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http/httptest"
 	"regexp"
+	"sync"
 	"testing"
 	"time"
 
@@ -48,6 +53,210 @@ func TestManualJWTManager(t *testing.T) {
 	assert.Equal(t, claims["aud"], "foo")
 }
 
+// countingTokenRetriever returns test tokens after an optional delay, and
+// counts the calls for each audience.
+type countingTokenRetriever struct {
+	t     *testing.T
+	delay time.Duration
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (r *countingTokenRetriever) GetToken(aud string) (string, error) {
+	r.mu.Lock()
+	r.calls[aud]++
+	r.mu.Unlock()
+	time.Sleep(r.delay)
+	return newTestToken(r.t, aud, "test-subject"), nil
+}
+
+func (r *countingTokenRetriever) callCounts() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return maps.Clone(r.calls)
+}
+
+func (r *countingTokenRetriever) Configure(_ interface{}) error {
+	return nil
+}
+
+func TestJwtManager_Audiences(t *testing.T) {
+	retriever := &countingTokenRetriever{t: t, calls: map[string]int{}}
+	manager := NewJwtManager(retriever)
+
+	for i := 0; i < 2; i++ {
+		for _, aud := range []string{"first-svc", "second-svc"} {
+			token, err := manager.Token(aud)
+			assert.NoError(t, err)
+			assert.NoError(t, checkTokenAudience(token, aud))
+		}
+	}
+	assert.Equal(t, map[string]int{"first-svc": 1, "second-svc": 1}, retriever.callCounts())
+
+	// Tokens for audiences that are not used are evicted.
+	manager.idleTimeout = 50 * time.Millisecond
+	time.Sleep(100 * time.Millisecond)
+	_, err := manager.Token("first-svc")
+	assert.NoError(t, err)
+	assert.Len(t, manager.tokens, 1)
+	assert.Contains(t, manager.tokens, "first-svc")
+	assert.Equal(t, 2, retriever.callCounts()["first-svc"])
+}
+
+func TestJwtManager_Concurrent(t *testing.T) {
+	retriever := &countingTokenRetriever{t: t, delay: 50 * time.Millisecond, calls: map[string]int{}}
+	manager := NewJwtManager(retriever)
+	audiences := []string{"first-svc", "second-svc", "third-svc"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(aud string) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				token, err := manager.Token(aud)
+				assert.NoError(t, err)
+				assert.NoError(t, checkTokenAudience(token, aud))
+			}
+		}(audiences[i%len(audiences)])
+	}
+	wg.Wait()
+
+	// Concurrent requests for each audience share a single refresh.
+	assert.Equal(t, map[string]int{"first-svc": 1, "second-svc": 1, "third-svc": 1}, retriever.callCounts())
+}
+
+// renewingTokenRetriever returns test tokens with a fixed lifetime, or an
+// error once it is set to fail.
+type renewingTokenRetriever struct {
+	lifetime time.Duration
+
+	mu    sync.Mutex
+	calls int
+	fail  bool
+}
+
+func (r *renewingTokenRetriever) GetToken(aud string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls++
+	if r.fail {
+		return "", errors.New("test failure")
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(
+		jwt.SigningMethodHS256, jwt.MapClaims{
+			"aud": aud,
+			"iss": "https://test-issuer",
+			"sub": "test-subject",
+			"iat": now.Unix(),
+			"exp": now.Add(r.lifetime).Unix(),
+			"jti": fmt.Sprint(r.calls),
+		},
+	)
+	return token.SignedString([]byte("testing"))
+}
+
+func (r *renewingTokenRetriever) Configure(_ interface{}) error {
+	return nil
+}
+
+func (r *renewingTokenRetriever) setFail(fail bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fail = fail
+}
+
+func (r *renewingTokenRetriever) callCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls
+}
+
+func TestJwtManager_RenewTime(t *testing.T) {
+	manager := NewJwtManager(nil)
+	issuedAt := time.Unix(1700000000, 0)
+	expiresAt := issuedAt.Add(time.Hour)
+
+	assert.Equal(t, issuedAt.Add(48*time.Minute), manager.renewTime(issuedAt, expiresAt))
+
+	manager.SetRenewal(0.8, 30*time.Minute)
+	assert.Equal(t, issuedAt.Add(30*time.Minute), manager.renewTime(issuedAt, expiresAt))
+
+	manager.SetRenewal(1, 0)
+	assert.Equal(t, expiresAt, manager.renewTime(issuedAt, expiresAt))
+}
+
+func TestJwtManager_BackgroundRenewal(t *testing.T) {
+	retriever := &renewingTokenRetriever{lifetime: 3 * time.Second}
+	manager := NewJwtManager(retriever)
+	manager.SetRenewal(0.1, 0)
+	manager.minRenew = 0
+	manager.done = make(chan struct{})
+	go manager.run(10 * time.Millisecond)
+	defer manager.Stop()
+
+	first, err := manager.Token("test-svc")
+	assert.NoError(t, err)
+
+	// The token is renewed in the background without being requested.
+	assert.Eventually(
+		t, func() bool {
+			return retriever.callCount() > 1
+		}, 2*time.Second, 10*time.Millisecond,
+	)
+	second, err := manager.Token("test-svc")
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, second)
+
+	// Renewal failures are reported, and the current token is used until it
+	// expires.
+	retriever.setFail(true)
+	calls := retriever.callCount()
+	assert.Eventually(
+		t, func() bool {
+			return retriever.callCount() > calls
+		}, 2*time.Second, 10*time.Millisecond,
+	)
+	assert.Eventually(
+		t, func() bool {
+			status := manager.Status()
+			return len(status) == 1 && status[0].LastError != ""
+		}, time.Second, 10*time.Millisecond,
+	)
+	status := manager.Status()
+	assert.True(t, status[0].Valid)
+	assert.Equal(t, "test failure", status[0].LastError)
+
+	third, err := manager.Token("test-svc")
+	assert.NoError(t, err)
+	assert.Contains(t, []string{first, second}, third)
+}
+
+func TestJwtManager_MinRenewInterval(t *testing.T) {
+	// The token lifetime is shorter than the renewal skew, so every new token
+	// is already due for renewal.
+	retriever := &renewingTokenRetriever{lifetime: 30 * time.Second}
+	manager := NewJwtManager(retriever)
+	manager.SetRenewal(0.8, time.Minute)
+	manager.done = make(chan struct{})
+	go manager.run(10 * time.Millisecond)
+	defer manager.Stop()
+
+	_, err := manager.Token("test-svc")
+	assert.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, retriever.callCount())
+
+	status := manager.Status()
+	assert.True(t, status[0].RenewAfter.After(time.Now()))
+
+	// Stop may be called on a JwtManager that was not started.
+	NewJwtManager(retriever).Stop()
+}
+
 func TestValidatableMapClaims_ValidateClaims(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -210,3 +419,114 @@ func TestValidatableMapClaims_ValidateClaims(t *testing.T) {
 		)
 	}
 }
+
+func TestJwtManager_RequestClaims(t *testing.T) {
+	retriever := new(ManualTokenRetriever)
+	err := retriever.Configure(
+		&ManualTokenConfig{
+			Key:           "testing",
+			SigningMethod: "hs256",
+			Issuer:        "https://foo",
+			Subject:       "foo@test",
+			Claims:        `{"tenant": "{{ header \"X-Tenant\" }}", "groups": ["a", "b"]}`,
+			TokenId:       true,
+		},
+	)
+	assert.NoError(t, err)
+	manager := NewJwtManager(retriever)
+
+	tokenClaims := func(tenant string) jwt.MapClaims {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tenant != "" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+		token, err := manager.RequestToken("foo", req)
+		assert.NoError(t, err)
+		claims := jwt.MapClaims{}
+		_, _, err = jwt.NewParser().ParseUnverified(token, claims)
+		assert.NoError(t, err)
+		return claims
+	}
+
+	first := tokenClaims("first")
+	assert.Equal(t, "first", first["tenant"])
+	assert.Equal(t, []interface{}{"a", "b"}, first["groups"])
+	assert.Equal(t, first["jti"], tokenClaims("first")["jti"])
+
+	second := tokenClaims("second")
+	assert.Equal(t, "second", second["tenant"])
+	assert.NotEqual(t, first["jti"], second["jti"])
+
+	// A templated claim that resolves to an empty value is an error.
+	_, err = manager.RequestToken("foo", httptest.NewRequest("GET", "/", nil))
+	assert.ErrorContains(t, err, "claim tenant resolved to an empty value")
+	_, err = manager.Token("foo")
+	assert.Error(t, err)
+
+	// The status of tokens with request claims does not include the claims.
+	status := manager.Status()
+	assert.Len(t, status, 2)
+	for _, s := range status {
+		assert.True(t, s.RequestClaims)
+		assert.True(t, s.Valid)
+		assert.Zero(t, s.RenewAfter)
+	}
+
+	// The least recently used token with request claims is evicted.
+	cached := func(tenant string) bool {
+		_, ok := manager.tokens[tokenRequest{aud: "foo", claims: map[string]interface{}{"tenant": tenant}}.key()]
+		return ok
+	}
+	manager.maxClaims = 2
+	third := tokenClaims("third")
+	assert.Equal(t, "third", third["tenant"])
+	assert.Len(t, manager.Status(), 2)
+	assert.False(t, cached("first"))
+	assert.True(t, cached("second"))
+	assert.True(t, cached("third"))
+}
+
+func TestJwtManager_StaticClaimTemplates(t *testing.T) {
+	t.Setenv("TEST_TENANT", "acme")
+	retriever := new(ManualTokenRetriever)
+	err := retriever.Configure(
+		&ManualTokenConfig{
+			Key:           "testing",
+			SigningMethod: "hs256",
+			Issuer:        "https://foo",
+			Subject:       "foo@test",
+			Claims:        `{"tenant": "{{ env \"TEST_TENANT\" }}", "context": {"tenant": "{{ if true }}{{ env \"TEST_TENANT\" }}{{ end }}"}}`,
+		},
+	)
+	assert.NoError(t, err)
+
+	// Templates that do not use request headers are resolved once, so the
+	// token is cached like a token with static claims.
+	claims, err := retriever.RequestClaims(httptest.NewRequest("GET", "/", nil))
+	assert.NoError(t, err)
+	assert.Nil(t, claims)
+
+	manager := NewJwtManager(retriever)
+	token, err := manager.Token("foo")
+	assert.NoError(t, err)
+	tokenClaims := jwt.MapClaims{}
+	_, _, err = jwt.NewParser().ParseUnverified(token, tokenClaims)
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", tokenClaims["tenant"])
+	assert.Equal(t, map[string]interface{}{"tenant": "acme"}, tokenClaims["context"])
+	status := manager.Status()
+	assert.Len(t, status, 1)
+	assert.False(t, status[0].RequestClaims)
+
+	// A template that resolves to an empty value is an error when configured.
+	err = retriever.Configure(
+		&ManualTokenConfig{
+			Key:           "testing",
+			SigningMethod: "hs256",
+			Issuer:        "https://foo",
+			Subject:       "foo@test",
+			Claims:        `{"tenant": "{{ env \"TEST_MISSING\" }}"}`,
+		},
+	)
+	assert.ErrorContains(t, err, "claim tenant resolved to an empty value")
+}
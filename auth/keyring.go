@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A keyringEntry is a key in a keyring file. A keyring is either a single
+// file containing a JSON or YAML list of entries, or a directory where each
+// file contains a single entry.
+type keyringEntry struct {
+	KeyId     string    `json:"kid" yaml:"kid"`
+	Key       string    `json:"key,omitempty" yaml:"key"`
+	KeyFile   string    `json:"key_file,omitempty" yaml:"key_file"`
+	NotBefore time.Time `json:"not_before" yaml:"not_before"`
+}
+
+// A manualKey is a key in a keyring. It is used for signing from its
+// activation time until the next key in the keyring is activated.
+type manualKey struct {
+	id        string
+	key       interface{}
+	notBefore time.Time
+}
+
+// A manualKeyring is a set of keys ordered by activation time.
+type manualKeyring struct {
+	keys []manualKey
+}
+
+// readKeyring reads the keyring file or directory at path, and the key files
+// referenced by its entries, and returns the entries encoded as JSON. Changes
+// to any of the files are reflected in the returned contents.
+func readKeyring(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []keyringEntry
+	dir := filepath.Dir(path)
+	if info.IsDir() {
+		dir = path
+		files, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			// Skip hidden files, which includes the ..data symlinks created
+			// by the kubelet for secret volumes.
+			if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
+			b, err := os.ReadFile(filepath.Join(path, f.Name()))
+			if err != nil {
+				return nil, err
+			}
+			entry := keyringEntry{}
+			err = yaml.Unmarshal(b, &entry)
+			if err != nil {
+				return nil, fmt.Errorf("unable to decode keyring entry %v: %w", f.Name(), err)
+			}
+			entries = append(entries, entry)
+		}
+	} else {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = yaml.Unmarshal(b, &entries)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode keyring: %w", err)
+		}
+	}
+
+	for i, entry := range entries {
+		if entry.KeyFile == "" {
+			continue
+		}
+		if entry.Key != "" {
+			return nil, fmt.Errorf("only one of key or key file may be specified for key %v", entry.KeyId)
+		}
+		keyPath := entry.KeyFile
+		if !filepath.IsAbs(keyPath) {
+			keyPath = filepath.Join(dir, keyPath)
+		}
+		b, err := os.ReadFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].Key = string(b)
+		entries[i].KeyFile = ""
+	}
+
+	return json.Marshal(entries)
+}
+
+// parseKeyring parses keyring entries read by readKeyring, using detect to
+// parse each key. Keys without a key ID use the RFC 7638 thumbprint of the key.
+func parseKeyring(b []byte, detect func([]byte) (interface{}, error)) (*manualKeyring, error) {
+	var entries []keyringEntry
+	err := json.Unmarshal(b, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode keyring: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("keyring does not contain any keys")
+	}
+
+	keyring := &manualKeyring{}
+	for _, entry := range entries {
+		if entry.Key == "" {
+			return nil, fmt.Errorf("key must not be empty for key %v", entry.KeyId)
+		}
+		key, err := detect([]byte(entry.Key))
+		if err != nil {
+			return nil, fmt.Errorf("unable to detect key %v: %w", entry.KeyId, err)
+		}
+		id := entry.KeyId
+		if id == "" {
+			id, err = jwkThumbprint(key)
+			if err != nil {
+				return nil, errors.New("a key ID is required for symmetric keys")
+			}
+		}
+		if _, ok := keyring.lookup(id); ok {
+			return nil, fmt.Errorf("duplicate key ID in keyring: %v", id)
+		}
+		keyring.keys = append(keyring.keys, manualKey{id: id, key: key, notBefore: entry.NotBefore})
+	}
+	slices.SortStableFunc(keyring.keys, func(a, b manualKey) int {
+		return a.notBefore.Compare(b.notBefore)
+	})
+
+	return keyring, nil
+}
+
+// current returns the most recently activated key.
+func (k *manualKeyring) current(now time.Time) (manualKey, error) {
+	for i := len(k.keys) - 1; i >= 0; i-- {
+		if !k.keys[i].notBefore.After(now) {
+			return k.keys[i], nil
+		}
+	}
+	return manualKey{}, errors.New("no key in the keyring has been activated")
+}
+
+// lookup returns the key with the key ID.
+func (k *manualKeyring) lookup(id string) (manualKey, bool) {
+	for _, key := range k.keys {
+		if key.id == id {
+			return key, true
+		}
+	}
+	return manualKey{}, false
+}
+
+// published returns the keys that verifiers should accept: keys that have not
+// been activated yet, the current key, and keys that were replaced less than
+// retention ago.
+func (k *manualKeyring) published(now time.Time, retention time.Duration) []manualKey {
+	var keys []manualKey
+	for i, key := range k.keys {
+		if i+1 < len(k.keys) && !k.keys[i+1].notBefore.Add(retention).After(now) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadKeyring(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "second.pem"), []byte("second-secret"), 0600)
+	assert.NoError(t, err)
+
+	keyringPath := filepath.Join(dir, "keyring.yaml")
+	err = os.WriteFile(
+		keyringPath, []byte(`
+- kid: first
+  key: first-secret
+  not_before: 2024-01-01T00:00:00Z
+- kid: second
+  key_file: second.pem
+  not_before: 2024-02-01T00:00:00Z
+`), 0600,
+	)
+	assert.NoError(t, err)
+
+	b, err := readKeyring(keyringPath)
+	assert.NoError(t, err)
+	keyring, err := parseKeyring(b, func(b []byte) (interface{}, error) { return b, nil })
+	assert.NoError(t, err)
+	assert.Len(t, keyring.keys, 2)
+	key, ok := keyring.lookup("second")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("second-secret"), key.key)
+
+	keyringDir := filepath.Join(dir, "keys")
+	assert.NoError(t, os.Mkdir(keyringDir, 0700))
+	err = os.WriteFile(
+		filepath.Join(keyringDir, "first.json"),
+		[]byte(`{"kid": "first", "key": "first-secret", "not_before": "2024-01-01T00:00:00Z"}`), 0600,
+	)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(keyringDir, ".hidden"), []byte("not a key"), 0600)
+	assert.NoError(t, err)
+
+	b, err = readKeyring(keyringDir)
+	assert.NoError(t, err)
+	keyring, err = parseKeyring(b, func(b []byte) (interface{}, error) { return b, nil })
+	assert.NoError(t, err)
+	assert.Len(t, keyring.keys, 1)
+
+	err = os.WriteFile(
+		filepath.Join(keyringDir, "duplicate.yaml"), []byte("kid: first\nkey: other-secret\n"), 0600,
+	)
+	assert.NoError(t, err)
+	b, err = readKeyring(keyringDir)
+	assert.NoError(t, err)
+	_, err = parseKeyring(b, func(b []byte) (interface{}, error) { return b, nil })
+	assert.ErrorContains(t, err, "duplicate key ID")
+}
+
+func TestManualKeyring(t *testing.T) {
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	keyring := &manualKeyring{
+		keys: []manualKey{
+			{id: "retired", notBefore: now.Add(-30 * 24 * time.Hour)},
+			{id: "previous", notBefore: now.Add(-2 * 24 * time.Hour)},
+			{id: "current", notBefore: now.Add(-30 * time.Minute)},
+			{id: "upcoming", notBefore: now.Add(24 * time.Hour)},
+		},
+	}
+
+	current, err := keyring.current(now)
+	assert.NoError(t, err)
+	assert.Equal(t, "current", current.id)
+
+	var published []string
+	for _, key := range keyring.published(now, time.Hour) {
+		published = append(published, key.id)
+	}
+	assert.Equal(t, []string{"previous", "current", "upcoming"}, published)
+
+	_, err = keyring.current(now.Add(-365 * 24 * time.Hour))
+	assert.ErrorContains(t, err, "no key in the keyring has been activated")
+}
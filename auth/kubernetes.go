@@ -0,0 +1,289 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// kubernetesNamespacePath is the path to the namespace of the pod in the
+// default service account volume.
+const kubernetesNamespacePath = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// KubernetesTokenRetriever is an implementation of JwtTokenRetriever for
+// projected Kubernetes service account tokens. The token file is watched and
+// re-read when the kubelet rotates the token.
+type KubernetesTokenRetriever struct {
+	mu      sync.RWMutex
+	token   string
+	watcher *fileWatcher
+}
+
+// A KubernetesTokenConfig contains configuration data used to initialize and
+// validate a KubernetesTokenRetriever object.
+type KubernetesTokenConfig struct {
+	TokenPath      string        `long:"token-path" env:"TOKEN_PATH" description:"Path to the projected service account token" default:"/var/run/secrets/tokens/oidc-token"`
+	ReloadInterval time.Duration `long:"reload-interval" env:"RELOAD_INTERVAL" description:"Interval for checking the token file for changes" default:"30s"`
+	Audience       string        `no-flag:"true"`
+}
+
+// GetToken returns the most recently read projected token. An error is
+// returned if the token was not issued for the requested audience.
+func (r *KubernetesTokenRetriever) GetToken(aud string) (string, error) {
+	token := r.currentToken()
+	if token == "" {
+		return "", errors.New("projected token file is empty")
+	}
+
+	err := checkTokenAudience(token, aud)
+	if err != nil {
+		return "", fmt.Errorf("projected token is not valid: %w", err)
+	}
+
+	return token, nil
+}
+
+// Configure will take a valid KubernetesTokenConfig and use it to configure the token retriever.
+func (r *KubernetesTokenRetriever) Configure(config interface{}) error {
+	c, ok := config.(*KubernetesTokenConfig)
+	if !ok {
+		log.Fatalln("internal error: incorrect token config")
+	}
+	if c.TokenPath == "" {
+		return errors.New("token path must not be empty")
+	}
+
+	// Stop watching a token file from a previous configuration, so that it
+	// does not replace the token read from the new file.
+	r.watcher.Stop()
+	r.watcher = nil
+
+	watcher, err := watchFile(c.TokenPath, c.ReloadInterval, r.setToken)
+	if errors.Is(err, fs.ErrNotExist) {
+		return unavailable(fmt.Errorf("unable to read projected token: %w", err))
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read projected token: %w", err)
+	}
+	if c.Audience != "" {
+		_, err = r.GetToken(c.Audience)
+		if err != nil {
+			watcher.Stop()
+			return err
+		}
+	}
+	r.watcher = watcher
+
+	return nil
+}
+
+// currentToken returns the most recently read token.
+func (r *KubernetesTokenRetriever) currentToken() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.token
+}
+
+// setToken replaces the current token with the contents of the token file.
+func (r *KubernetesTokenRetriever) setToken(b []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.token = strings.TrimSpace(string(b))
+}
+
+// checkTokenAudience confirms that an unverified token contains the
+// requested audience in its aud claim.
+func checkTokenAudience(token string, aud string) error {
+	claims := jwt.MapClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(token, claims)
+	if err != nil {
+		return fmt.Errorf("unable to parse JWT: %w", err)
+	}
+
+	tokenAud, err := claims.GetAudience()
+	if err != nil {
+		return fmt.Errorf("unable to read audience claim: %w", err)
+	}
+	if !slices.Contains(tokenAud, aud) {
+		return fmt.Errorf("token audience %v does not match expected audience %v", []string(tokenAud), aud)
+	}
+
+	return nil
+}
+
+// KubernetesApiTokenRetriever is an implementation of JwtTokenRetriever that
+// uses the Kubernetes TokenRequest API to mint service account tokens for
+// each requested audience. The API server is accessed using the in-cluster
+// service account credentials.
+type KubernetesApiTokenRetriever struct {
+	server         string
+	namespace      string
+	serviceAccount string
+	expiration     int64
+	client         *http.Client
+	credentials    KubernetesTokenRetriever
+}
+
+// A KubernetesApiTokenConfig contains configuration data used to initialize
+// and validate a KubernetesApiTokenRetriever object.
+type KubernetesApiTokenConfig struct {
+	Server            string        `long:"server" env:"SERVER" description:"Kubernetes API server URL (defaults to the in-cluster API server)"`
+	CaPath            string        `long:"ca-path" env:"CA_PATH" description:"Path to the Kubernetes API server CA certificate" default:"/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"`
+	CredentialsPath   string        `long:"credentials-path" env:"CREDENTIALS_PATH" description:"Path to the service account token used to call the Kubernetes API" default:"/var/run/secrets/kubernetes.io/serviceaccount/token"`
+	Namespace         string        `long:"namespace" env:"NAMESPACE" description:"Namespace of the service account (defaults to the pod namespace)"`
+	ServiceAccount    string        `long:"service-account" env:"SERVICE_ACCOUNT" description:"Name of the service account to request tokens for"`
+	ExpirationSeconds int64         `long:"expiration-seconds" env:"EXPIRATION_SECONDS" description:"Requested lifetime of minted tokens in seconds" default:"3600"`
+	ReloadInterval    time.Duration `long:"reload-interval" env:"RELOAD_INTERVAL" description:"Interval for checking the credentials file for changes" default:"30s"`
+}
+
+// kubernetesTokenRequest is the subset of the authentication.k8s.io/v1
+// TokenRequest resource used by the KubernetesApiTokenRetriever.
+type kubernetesTokenRequest struct {
+	ApiVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		Audiences         []string `json:"audiences"`
+		ExpirationSeconds int64    `json:"expirationSeconds,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Token string `json:"token"`
+	} `json:"status"`
+}
+
+// GetToken requests a new service account token for the audience from the
+// Kubernetes TokenRequest API.
+func (r *KubernetesApiTokenRetriever) GetToken(aud string) (string, error) {
+	credentials := r.credentials.currentToken()
+	if credentials == "" {
+		return "", errors.New("Kubernetes API credentials file is empty")
+	}
+
+	tokenRequest := kubernetesTokenRequest{
+		ApiVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenRequest",
+	}
+	tokenRequest.Spec.Audiences = []string{aud}
+	tokenRequest.Spec.ExpirationSeconds = r.expiration
+	reqBody, err := json.Marshal(tokenRequest)
+	if err != nil {
+		return "", fmt.Errorf("error encoding token request: %w", err)
+	}
+
+	endpoint := fmt.Sprintf(
+		"%v/api/v1/namespaces/%v/serviceaccounts/%v/token", r.server, url.PathEscape(r.namespace),
+		url.PathEscape(r.serviceAccount),
+	)
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return "", fmt.Errorf("error creating token request: %w", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", credentials))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unsuccessful status code while fetching token: %v, %v", resp.StatusCode, string(body))
+	}
+
+	tokenResponse := kubernetesTokenRequest{}
+	err = json.Unmarshal(body, &tokenResponse)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode token response: %w", err)
+	}
+	if tokenResponse.Status.Token == "" {
+		return "", errors.New("token response did not contain a token")
+	}
+
+	return tokenResponse.Status.Token, nil
+}
+
+// Configure will take a valid KubernetesApiTokenConfig and use it to configure the token retriever.
+func (r *KubernetesApiTokenRetriever) Configure(config interface{}) error {
+	c, ok := config.(*KubernetesApiTokenConfig)
+	if !ok {
+		log.Fatalln("internal error: incorrect token config")
+	}
+	if c.ServiceAccount == "" {
+		return errors.New("service account name must not be empty")
+	}
+	if c.ExpirationSeconds < 0 {
+		return errors.New("expiration seconds must not be negative")
+	}
+
+	r.server = strings.TrimSuffix(c.Server, "/")
+	if r.server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return unavailable(errors.New("Kubernetes API server must be specified when not running in a cluster"))
+		}
+		r.server = "https://" + net.JoinHostPort(host, port)
+	}
+
+	r.namespace = c.Namespace
+	if r.namespace == "" {
+		b, err := os.ReadFile(kubernetesNamespacePath)
+		if err != nil {
+			return fmt.Errorf("unable to determine pod namespace: %w", err)
+		}
+		r.namespace = strings.TrimSpace(string(b))
+	}
+
+	tlsConfig := &tls.Config{}
+	if c.CaPath != "" {
+		caData, err := os.ReadFile(c.CaPath)
+		if err != nil {
+			return fmt.Errorf("unable to read Kubernetes API CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return errors.New("no certificates found in Kubernetes API CA file")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	r.client = &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+	}
+
+	err := r.credentials.Configure(
+		&KubernetesTokenConfig{
+			TokenPath:      c.CredentialsPath,
+			ReloadInterval: c.ReloadInterval,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("unable to read Kubernetes API credentials: %w", err)
+	}
+
+	r.serviceAccount = c.ServiceAccount
+	r.expiration = c.ExpirationSeconds
+
+	return nil
+}
@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestToken returns an HMAC signed token with standard OIDC claims for the
+// given audience and subject.
+func newTestToken(t *testing.T, aud string, sub string) string {
+	t.Helper()
+	now := time.Now()
+	token := jwt.NewWithClaims(
+		jwt.SigningMethodHS256, jwt.MapClaims{
+			"aud": aud,
+			"iss": "https://test-issuer",
+			"sub": sub,
+			"iat": now.Unix(),
+			"exp": now.Add(time.Hour).Unix(),
+		},
+	)
+	tokenString, err := token.SignedString([]byte("testing"))
+	assert.NoError(t, err)
+	return tokenString
+}
+
+func TestKubernetesTokenRetriever(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	firstToken := newTestToken(t, "test-svc", "first")
+	err := os.WriteFile(tokenPath, []byte(firstToken+"\n"), 0600)
+	assert.NoError(t, err)
+
+	retriever := new(KubernetesTokenRetriever)
+	err = retriever.Configure(
+		&KubernetesTokenConfig{
+			TokenPath:      tokenPath,
+			ReloadInterval: 10 * time.Millisecond,
+		},
+	)
+	assert.NoError(t, err)
+	defer retriever.watcher.Stop()
+
+	token, err := retriever.GetToken("test-svc")
+	assert.NoError(t, err)
+	assert.Equal(t, firstToken, token)
+
+	_, err = retriever.GetToken("other-svc")
+	assert.ErrorContains(t, err, "does not match expected audience")
+
+	secondToken := newTestToken(t, "test-svc", "second")
+	err = os.WriteFile(tokenPath, []byte(secondToken), 0600)
+	assert.NoError(t, err)
+	assert.Eventually(
+		t, func() bool {
+			token, err := retriever.GetToken("test-svc")
+			return err == nil && token == secondToken
+		}, time.Second, 10*time.Millisecond,
+	)
+}
+
+func TestKubernetesTokenRetriever_Audience(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(tokenPath, []byte(newTestToken(t, "test-svc", "test")), 0600)
+	assert.NoError(t, err)
+
+	retriever := new(KubernetesTokenRetriever)
+	err = retriever.Configure(&KubernetesTokenConfig{TokenPath: tokenPath, Audience: "test-svc"})
+	assert.NoError(t, err)
+	retriever.watcher.Stop()
+
+	// A projected token for a different audience fails at startup.
+	retriever = new(KubernetesTokenRetriever)
+	err = retriever.Configure(&KubernetesTokenConfig{TokenPath: tokenPath, Audience: "other-svc"})
+	assert.ErrorContains(t, err, "does not match expected audience")
+	assert.Nil(t, retriever.watcher)
+}
+
+func TestKubernetesTokenRetriever_Reconfigure(t *testing.T) {
+	dir := t.TempDir()
+	firstPath := filepath.Join(dir, "first")
+	secondPath := filepath.Join(dir, "second")
+	secondToken := newTestToken(t, "test-svc", "second")
+	assert.NoError(t, os.WriteFile(firstPath, []byte(newTestToken(t, "test-svc", "first")), 0600))
+	assert.NoError(t, os.WriteFile(secondPath, []byte(secondToken), 0600))
+
+	retriever := new(KubernetesTokenRetriever)
+	err := retriever.Configure(&KubernetesTokenConfig{TokenPath: firstPath, ReloadInterval: 10 * time.Millisecond})
+	assert.NoError(t, err)
+	err = retriever.Configure(&KubernetesTokenConfig{TokenPath: secondPath, ReloadInterval: 10 * time.Millisecond})
+	assert.NoError(t, err)
+	defer retriever.watcher.Stop()
+
+	// Changes to the previously configured file are no longer read.
+	assert.NoError(t, os.WriteFile(firstPath, []byte(newTestToken(t, "test-svc", "changed")), 0600))
+	time.Sleep(50 * time.Millisecond)
+	token, err := retriever.GetToken("test-svc")
+	assert.NoError(t, err)
+	assert.Equal(t, secondToken, token)
+}
+
+func TestKubernetesTokenRetriever_MissingFile(t *testing.T) {
+	retriever := new(KubernetesTokenRetriever)
+	err := retriever.Configure(
+		&KubernetesTokenConfig{
+			TokenPath: filepath.Join(t.TempDir(), "missing"),
+		},
+	)
+	assert.Error(t, err)
+}
+
+func TestKubernetesApiTokenRetriever(t *testing.T) {
+	dir := t.TempDir()
+	credentials := newTestToken(t, "https://kubernetes.default.svc", "system:serviceaccount:test-ns:proxy")
+	credentialsPath := filepath.Join(dir, "token")
+	err := os.WriteFile(credentialsPath, []byte(credentials), 0600)
+	assert.NoError(t, err)
+
+	server := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(rw http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "POST", r.Method)
+				assert.Equal(t, "/api/v1/namespaces/test-ns/serviceaccounts/test-sa/token", r.URL.Path)
+				if r.Header.Get("Authorization") != "Bearer "+credentials {
+					rw.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+
+				tokenRequest := kubernetesTokenRequest{}
+				err := json.NewDecoder(r.Body).Decode(&tokenRequest)
+				assert.NoError(t, err)
+				assert.Equal(t, int64(600), tokenRequest.Spec.ExpirationSeconds)
+				assert.Len(t, tokenRequest.Spec.Audiences, 1)
+
+				tokenRequest.Status.Token = newTestToken(t, tokenRequest.Spec.Audiences[0], "test-sa")
+				rw.WriteHeader(http.StatusCreated)
+				_ = json.NewEncoder(rw).Encode(tokenRequest)
+			},
+		),
+	)
+	defer server.Close()
+
+	caPath := filepath.Join(dir, "ca.crt")
+	caData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	err = os.WriteFile(caPath, caData, 0600)
+	assert.NoError(t, err)
+
+	retriever := new(KubernetesApiTokenRetriever)
+	err = retriever.Configure(
+		&KubernetesApiTokenConfig{
+			Server:            server.URL,
+			CaPath:            caPath,
+			CredentialsPath:   credentialsPath,
+			Namespace:         "test-ns",
+			ServiceAccount:    "test-sa",
+			ExpirationSeconds: 600,
+		},
+	)
+	assert.NoError(t, err)
+
+	for _, aud := range []string{"first-svc", "second-svc"} {
+		token, err := retriever.GetToken(aud)
+		assert.NoError(t, err)
+		assert.NoError(t, checkTokenAudience(token, aud))
+	}
+
+	err = retriever.Configure(
+		&KubernetesApiTokenConfig{
+			Server:          server.URL,
+			CaPath:          caPath,
+			CredentialsPath: credentialsPath,
+			Namespace:       "test-ns",
+		},
+	)
+	assert.Error(t, err)
+}
@@ -1,62 +1,235 @@
 package auth
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// defaultManualTokenLifetime is the lifetime of manually signed tokens when
+// a lifetime is not configured.
+const defaultManualTokenLifetime = 1 * time.Hour
+
 // ManualTokenRetriever is an implementation of JwtTokenRetriever for OIDC
 // identity tokens created manually using a user-provided key.
 type ManualTokenRetriever struct {
-	issuer  string
-	subject string
+	issuer            string
+	subject           string
+	keyIdThumbprint   bool
+	signing           jwt.SigningMethod
+	claims            jwt.MapClaims
+	templates         map[string]interface{}
+	lifetime          time.Duration
+	notBeforeBackdate time.Duration
+	tokenId           bool
+
+	mu      sync.RWMutex
 	key     interface{}
-	signing jwt.SigningMethod
-	claims  jwt.MapClaims
+	keyId   string
+	keyring *manualKeyring
+	watcher *fileWatcher
 }
 
 // A ManualTokenConfig contains configuration data used to initialize and
 // validate a ManualTokenRetriever object.
 type ManualTokenConfig struct {
-	Issuer        string `long:"issuer" env:"ISSUER" description:"Manual authentication issuer claim"`
-	Subject       string `long:"subject" env:"SUBJECT" description:"Manual authentication subject claim"`
-	Key           string `long:"signing-key" env:"SIGNING_KEY" description:"Manual authentication signing key"`
-	SigningMethod string `long:"signing-method" env:"SIGNING_METHOD" description:"Manual authentication signing method"`
-	Claims        string `long:"claims" env:"CLAIMS" description:"Manual authentication additional claims"`
+	Issuer            string        `long:"issuer" env:"ISSUER" description:"Manual authentication issuer claim"`
+	Subject           string        `long:"subject" env:"SUBJECT" description:"Manual authentication subject claim"`
+	Key               string        `long:"signing-key" env:"SIGNING_KEY" description:"Manual authentication signing key"`
+	KeyFile           string        `long:"signing-key-file" env:"SIGNING_KEY_FILE" description:"Path to a file containing the manual authentication signing key"`
+	SigningMethod     string        `long:"signing-method" env:"SIGNING_METHOD" description:"Manual authentication signing method"`
+	Claims            string        `long:"claims" env:"CLAIMS" description:"Manual authentication additional claims, string values may be templates resolved for each request"`
+	Lifetime          time.Duration `long:"lifetime" env:"LIFETIME" description:"Manual authentication token lifetime" default:"1h"`
+	NotBeforeBackdate time.Duration `long:"not-before-backdate" env:"NOT_BEFORE_BACKDATE" description:"Set the not before claim this long before the token is issued to allow for clock skew"`
+	TokenId           bool          `long:"token-id" env:"TOKEN_ID" description:"Set a random JWT ID claim on each token"`
+	KeyId             string        `long:"key-id" env:"KEY_ID" description:"Key ID header for signed tokens"`
+	KeyIdThumbprint   bool          `long:"key-id-thumbprint" env:"KEY_ID_THUMBPRINT" description:"Use the RFC 7638 thumbprint of the signing key as the key ID header"`
+	Keyring           string        `long:"keyring" env:"KEYRING" description:"Path to a keyring file or directory of signing keys with activation times"`
+	ReloadInterval    time.Duration `long:"reload-interval" env:"RELOAD_INTERVAL" description:"Interval for checking the signing key file or keyring for changes" default:"30s"`
 }
 
 // A ManualKeyManager implements the KeyManager interface and supports manual
-// key assignment for JWT validation. It supports both RSA public keys and
-// HMAC secrets.
+// key assignment for JWT validation. It supports RSA, EC and Ed25519 public
+// keys, and HMAC secrets. With a keyring, the key is selected using the key ID
+// header of the token.
 type ManualKeyManager struct {
 	key            interface{}
 	expectedClaims *ValidatableMapClaims
+
+	mu      sync.RWMutex
+	keyring *manualKeyring
+	watcher *fileWatcher
 }
 
-// GetToken generates a new token from the provided audience, claims, and private key.
+// GetToken generates a new token from the provided audience, claims, and
+// private key. Templated claims are resolved without an incoming request.
 func (r *ManualTokenRetriever) GetToken(aud string) (string, error) {
-	token := jwt.New(r.signing)
-	claims := token.Claims.(jwt.MapClaims)
+	claims, err := r.RequestClaims(nil)
+	if err != nil {
+		return "", err
+	}
+	return r.GetTokenWithClaims(aud, claims)
+}
+
+// RequestClaims resolves the templated claims for the incoming request.
+func (r *ManualTokenRetriever) RequestClaims(req *http.Request) (map[string]interface{}, error) {
+	return executeClaimTemplates(r.templates, req)
+}
+
+// GetTokenWithClaims generates a new token like GetToken, using the resolved
+// values of the templated claims.
+func (r *ManualTokenRetriever) GetTokenWithClaims(aud string, requestClaims map[string]interface{}) (string, error) {
+	claims := jwt.MapClaims{}
 	now := time.Now()
 	claims["iat"] = now.Unix()
-	claims["exp"] = now.Add(1 * time.Hour).Unix()
+	claims["exp"] = now.Add(r.lifetime).Unix()
 	claims["aud"] = aud
 	claims["iss"] = r.issuer
 	claims["sub"] = r.subject
+	if r.tokenId {
+		jti, err := randomId()
+		if err != nil {
+			return "", err
+		}
+		claims["jti"] = jti
+	}
+	if r.notBeforeBackdate > 0 {
+		claims["nbf"] = now.Add(-r.notBeforeBackdate).Unix()
+	}
 
 	for k, v := range r.claims {
 		claims[k] = v
 	}
+	for k, v := range requestClaims {
+		if _, ok := r.templates[k]; ok {
+			claims[k] = v
+		}
+	}
+
+	return r.signClaims(claims)
+}
+
+// signClaims creates a new token from the claims and signs it with the
+// configured key, or the current key of the keyring.
+func (r *ManualTokenRetriever) signClaims(claims jwt.MapClaims) (string, error) {
+	key, keyId := r.currentKey()
+	if keyring := r.currentKeyring(); keyring != nil {
+		current, err := keyring.current(time.Now())
+		if err != nil {
+			return "", err
+		}
+		key, keyId = current.key, current.id
+	}
+
+	token := jwt.NewWithClaims(r.signing, claims)
+	if keyId != "" {
+		token.Header["kid"] = keyId
+	}
+	return token.SignedString(key)
+}
+
+// Issuer returns the issuer claim of the generated tokens.
+func (r *ManualTokenRetriever) Issuer() string {
+	return r.issuer
+}
+
+// SigningAlgorithms returns the algorithms used to sign the generated tokens.
+func (r *ManualTokenRetriever) SigningAlgorithms() []string {
+	return []string{r.signing.Alg()}
+}
+
+// Jwks returns a JSON web key set containing the public keys used to verify
+// the generated tokens. An error is returned if the signing key is symmetric,
+// or if no key ID is configured. With a keyring, keys that have not been
+// activated yet are included, and replaced keys are included until tokens
+// signed with them have expired.
+func (r *ManualTokenRetriever) Jwks() (*JsonWebKeySet, error) {
+	key, keyId := r.currentKey()
+	keys := []manualKey{{id: keyId, key: key}}
+	if keyring := r.currentKeyring(); keyring != nil {
+		keys = keyring.published(time.Now(), r.lifetime)
+	}
+
+	jwks := &JsonWebKeySet{Keys: []map[string]string{}}
+	for _, key := range keys {
+		jwk, err := publicJwk(key.key)
+		if err != nil {
+			return nil, errors.New("only asymmetric signing keys can be published")
+		}
+		if key.id == "" {
+			return nil, errors.New("a key ID is required to publish the signing key")
+		}
+		jwk["kid"] = key.id
+		jwk["alg"] = r.signing.Alg()
+		jwk["use"] = "sig"
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	return jwks, nil
+}
+
+// currentKey returns the most recently loaded signing key and its key ID.
+func (r *ManualTokenRetriever) currentKey() (interface{}, string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.key, r.keyId
+}
+
+// setKey replaces the signing key, and the key ID if it is the thumbprint of
+// the key.
+func (r *ManualTokenRetriever) setKey(b []byte) error {
+	key, err := detectManualKey(b, strings.ToUpper(r.signing.Alg()))
+	if err != nil {
+		return fmt.Errorf("unable to detect signing token: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.keyIdThumbprint {
+		keyId, err := jwkThumbprint(key)
+		if err != nil {
+			return fmt.Errorf("unable to compute key ID thumbprint, a thumbprint requires an asymmetric key: %w", err)
+		}
+		r.keyId = keyId
+	}
+	r.key = key
+	return nil
+}
+
+// currentKeyring returns the most recently loaded keyring, or nil if a
+// keyring is not configured.
+func (r *ManualTokenRetriever) currentKeyring() *manualKeyring {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keyring
+}
 
-	signedToken, err := token.SignedString(r.key)
+// setKeyring replaces the keyring with the contents of the keyring files. The
+// existing keyring is kept if the keyring files are not valid.
+func (r *ManualTokenRetriever) setKeyring(b []byte) {
+	keyring, err := parseKeyring(b, func(b []byte) (interface{}, error) {
+		return detectManualKey(b, strings.ToUpper(r.signing.Alg()))
+	})
+	if err != nil {
+		log.Printf("unable to load signing keyring: %v\n", err)
+		return
+	}
 
-	return signedToken, err
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keyring = keyring
 }
 
 // Configure will take a valid ManualTokenConfig and use it to configure the token retriever.
@@ -65,8 +238,11 @@ func (r *ManualTokenRetriever) Configure(config interface{}) error {
 	if !ok {
 		log.Fatalln("internal error: incorrect token config")
 	}
-	if c.Key == "" {
-		return errors.New("key must not be empty")
+	if c.Key == "" && c.KeyFile == "" && c.Keyring == "" {
+		return errors.New("key or keyring must not be empty")
+	}
+	if c.Keyring != "" && (c.Key != "" || c.KeyFile != "" || c.KeyId != "" || c.KeyIdThumbprint) {
+		return errors.New("key and key ID must not be specified with a keyring")
 	}
 	if c.SigningMethod == "" {
 		return errors.New("signing method must not be empty")
@@ -77,18 +253,51 @@ func (r *ManualTokenRetriever) Configure(config interface{}) error {
 	if c.Issuer == "" {
 		return errors.New("issuer must not be empty")
 	}
-
-	key, err := detectManualKey([]byte(c.Key), strings.ToUpper(c.SigningMethod))
-	if err != nil {
-		return fmt.Errorf("unable to detect signing token: %w", err)
+	if c.Lifetime < 0 {
+		return errors.New("lifetime must not be negative")
+	}
+	if c.NotBeforeBackdate < 0 {
+		return errors.New("not before backdate must not be negative")
+	}
+	if c.KeyId != "" && c.KeyIdThumbprint {
+		return errors.New("only one of key ID or key ID thumbprint may be specified")
 	}
-	r.key = key
 
-	r.signing = jwt.GetSigningMethod(strings.ToUpper(c.SigningMethod))
+	// Stop watching a key or keyring from a previous configuration, so that
+	// it does not replace the key loaded from the new configuration.
+	r.watcher.Stop()
+	r.watcher = nil
+	r.mu.Lock()
+	r.key = nil
+	r.keyring = nil
+	r.mu.Unlock()
+
+	r.signing = jwt.GetSigningMethod(signingMethodName(c.SigningMethod))
 	if r.signing == nil {
 		return errors.New("unknown signing method was specified")
 	}
 
+	r.keyId = c.KeyId
+	r.keyIdThumbprint = c.KeyIdThumbprint
+
+	var err error
+	if c.Keyring != "" {
+		r.watcher, err = watchPath(c.Keyring, c.ReloadInterval, readKeyring, r.setKeyring)
+		if err != nil {
+			return fmt.Errorf("unable to read signing keyring: %w", err)
+		}
+		if r.currentKeyring() == nil {
+			r.watcher.Stop()
+			r.watcher = nil
+			return errors.New("unable to load signing keyring")
+		}
+	} else {
+		r.watcher, err = watchSecret(c.Key, c.KeyFile, c.ReloadInterval, r.setKey)
+		if err != nil {
+			return err
+		}
+	}
+
 	r.issuer = c.Issuer
 	if r.issuer == "" {
 		return errors.New("issuer must be specified when using the manual auth type")
@@ -98,6 +307,13 @@ func (r *ManualTokenRetriever) Configure(config interface{}) error {
 		return errors.New("subject must be specified when using the manual auth type")
 	}
 
+	r.lifetime = c.Lifetime
+	if r.lifetime == 0 {
+		r.lifetime = defaultManualTokenLifetime
+	}
+	r.notBeforeBackdate = c.NotBeforeBackdate
+	r.tokenId = c.TokenId
+
 	claims, err := ConvertClaimString(c.Claims)
 	if err != nil {
 		log.Fatalf("error parsing manual claims: %v\n", err)
@@ -107,11 +323,37 @@ func (r *ManualTokenRetriever) Configure(config interface{}) error {
 		claims = new(jwt.MapClaims)
 	}
 
-	for _, k := range getReservedClaims() {
+	for _, k := range getReservedClaims(c) {
 		if _, ok := (*claims)[k]; ok {
 			log.Fatalf("reserved claim must be specified in config: %v\n", k)
 		}
 	}
+	templates, err := parseClaimTemplates(*claims)
+	if err != nil {
+		return err
+	}
+	// Templates that do not use request headers are resolved once, so that
+	// tokens are renewed in the background and persisted like tokens with
+	// static claims.
+	r.templates = make(map[string]interface{})
+	static := make(map[string]interface{})
+	for k, t := range templates {
+		if usesRequestHeaders(t) {
+			r.templates[k] = t
+		} else {
+			static[k] = t
+		}
+	}
+	resolved, err := executeClaimTemplates(static, nil)
+	if err != nil {
+		return err
+	}
+	for k := range r.templates {
+		delete(*claims, k)
+	}
+	for k, v := range resolved {
+		(*claims)[k] = v
+	}
 	r.claims = *claims
 
 	return nil
@@ -120,7 +362,7 @@ func (r *ManualTokenRetriever) Configure(config interface{}) error {
 // detectManualKey attempts to detect the key-type provided for manual JWT
 // creation and signing.
 func detectManualKey(b []byte, m string) (interface{}, error) {
-	if strings.HasPrefix(m, "RS") {
+	if strings.HasPrefix(m, "RS") || strings.HasPrefix(m, "PS") {
 		privKey, err := jwt.ParseRSAPrivateKeyFromPEM(b)
 		if err == nil {
 			log.Println("detected RSA private token")
@@ -128,6 +370,26 @@ func detectManualKey(b []byte, m string) (interface{}, error) {
 		}
 	}
 
+	if strings.HasPrefix(m, "ES") {
+		privKey, err := jwt.ParseECPrivateKeyFromPEM(b)
+		if err == nil {
+			method, ok := jwt.GetSigningMethod(m).(*jwt.SigningMethodECDSA)
+			if ok && privKey.Curve.Params().BitSize != method.CurveBits {
+				return nil, fmt.Errorf("EC private key curve does not match signing method: %v", m)
+			}
+			log.Println("detected EC private token")
+			return privKey, nil
+		}
+	}
+
+	if m == "EDDSA" {
+		privKey, err := jwt.ParseEdPrivateKeyFromPEM(b)
+		if err == nil {
+			log.Println("detected Ed25519 private token")
+			return privKey, nil
+		}
+	}
+
 	if strings.HasPrefix(m, "HS") {
 		decodedKey, err := base64.StdEncoding.DecodeString(string(b))
 		if err == nil {
@@ -145,7 +407,27 @@ func detectManualKey(b []byte, m string) (interface{}, error) {
 func (m *ManualKeyManager) Validate(tok string) (bool, error) {
 	claims := jwt.MapClaims{}
 	keyFunc := func(token *jwt.Token) (interface{}, error) {
-		return m.key, nil
+		m.mu.RLock()
+		key, keyring := m.key, m.keyring
+		m.mu.RUnlock()
+		if keyring != nil {
+			kid, ok := token.Header["kid"].(string)
+			if !ok {
+				return nil, errors.New("token does not have a key ID header")
+			}
+			ringKey, ok := keyring.lookup(kid)
+			if !ok {
+				return nil, fmt.Errorf("unknown key ID: %v", kid)
+			}
+			key = ringKey.key
+		}
+
+		// The signing method must match the type of the key, so that a
+		// public key is never used as an HMAC secret.
+		if !slices.Contains(validatingMethods(key), token.Method.Alg()) {
+			return nil, fmt.Errorf("signing method %v is not valid for the key", token.Method.Alg())
+		}
+		return key, nil
 	}
 	_, err := jwt.ParseWithClaims(
 		tok, &claims, keyFunc,
@@ -157,6 +439,22 @@ func (m *ManualKeyManager) Validate(tok string) (bool, error) {
 	return m.expectedClaims.ValidateClaims(&claims)
 }
 
+// validatingMethods returns the signing methods that may be used to validate
+// tokens with the key.
+func validatingMethods(key interface{}) []string {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}
+	case *ecdsa.PublicKey:
+		return []string{"ES256", "ES384", "ES512"}
+	case ed25519.PublicKey:
+		return []string{"EdDSA"}
+	case []byte:
+		return []string{"HS256", "HS384", "HS512"}
+	}
+	return nil
+}
+
 // NewManualKeyManager returns a new ManualKeyManager for the specified key.
 func NewManualKeyManager(key interface{}, claims *ValidatableMapClaims) *ManualKeyManager {
 	m := ManualKeyManager{
@@ -167,8 +465,82 @@ func NewManualKeyManager(key interface{}, claims *ValidatableMapClaims) *ManualK
 	return &m
 }
 
+// SetKey replaces the validating key. It is safe to call SetKey while tokens
+// are being validated.
+func (m *ManualKeyManager) SetKey(key interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.key = key
+}
+
+// NewManualKeyringManager returns a new ManualKeyManager for the keyring file
+// or directory at path. Keys are parsed using detect, and the keyring is
+// checked for changes at the interval. A changed keyring is rejected if a key
+// ID is reused for a different type of key.
+func NewManualKeyringManager(
+	path string, interval time.Duration, detect func([]byte) (interface{}, error), claims *ValidatableMapClaims,
+) (*ManualKeyManager, error) {
+	m := &ManualKeyManager{
+		expectedClaims: claims,
+	}
+
+	var err error
+	m.watcher, err = watchPath(path, interval, readKeyring, func(b []byte) {
+		keyring, err := parseKeyring(b, detect)
+		if err != nil {
+			log.Printf("unable to load validating keyring: %v\n", err)
+			return
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.keyring != nil {
+			for _, key := range keyring.keys {
+				previous, ok := m.keyring.lookup(key.id)
+				if ok && reflect.TypeOf(key.key) != reflect.TypeOf(previous.key) {
+					log.Printf(
+						"unable to load validating keyring: key %v type %T does not match the loaded key type %T\n",
+						key.id, key.key, previous.key,
+					)
+					return
+				}
+			}
+		}
+		m.keyring = keyring
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read validating keyring: %w", err)
+	}
+	m.mu.RLock()
+	keyring := m.keyring
+	m.mu.RUnlock()
+	if keyring == nil {
+		m.watcher.Stop()
+		return nil, errors.New("unable to load validating keyring")
+	}
+
+	return m, nil
+}
+
 // getReservedClaims returns a list of claims that can not be specified as
-// additional claims for validation,
-func getReservedClaims() []string {
-	return []string{"iat", "exp", "iss", "aud", "sub"}
+// additional claims for validation. The jti and nbf claims are only reserved
+// when they are set by the token retriever.
+func getReservedClaims(c *ManualTokenConfig) []string {
+	reserved := []string{"iat", "exp", "iss", "aud", "sub"}
+	if c.TokenId {
+		reserved = append(reserved, "jti")
+	}
+	if c.NotBeforeBackdate > 0 {
+		reserved = append(reserved, "nbf")
+	}
+	return reserved
+}
+
+// signingMethodName returns the registered name of a signing method, ignoring
+// case.
+func signingMethodName(m string) string {
+	if strings.EqualFold(m, "EdDSA") {
+		return "EdDSA"
+	}
+	return strings.ToUpper(m)
 }
@@ -1,11 +1,22 @@
 package auth
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
 )
 
 const privateKey = `
@@ -177,3 +188,419 @@ func TestManualKeyManager(t *testing.T) {
 	assert.False(t, v)
 	assert.NotNil(t, err)
 }
+
+func TestManualTokenRetriever_Asymmetric(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+	edPublicKey, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	pkcs8 := func(key interface{}) string {
+		b, err := x509.MarshalPKCS8PrivateKey(key)
+		assert.NoError(t, err)
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}))
+	}
+	sec1 := func(key *ecdsa.PrivateKey) string {
+		b, err := x509.MarshalECPrivateKey(key)
+		assert.NoError(t, err)
+		return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}))
+	}
+
+	tests := []struct {
+		method    string
+		key       string
+		publicKey interface{}
+	}{
+		{method: "PS256", key: pkcs8(rsaKey), publicKey: &rsaKey.PublicKey},
+		{method: "PS512", key: pkcs8(rsaKey), publicKey: &rsaKey.PublicKey},
+		{method: "ES256", key: sec1(p256Key), publicKey: &p256Key.PublicKey},
+		{method: "ES256", key: pkcs8(p256Key), publicKey: &p256Key.PublicKey},
+		{method: "ES384", key: sec1(p384Key), publicKey: &p384Key.PublicKey},
+		{method: "EdDSA", key: pkcs8(edKey), publicKey: edPublicKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.method, func(t *testing.T) {
+				retriever := new(ManualTokenRetriever)
+				err := retriever.Configure(
+					&ManualTokenConfig{
+						Key:           tt.key,
+						SigningMethod: tt.method,
+						Issuer:        "https://foo",
+						Subject:       "foo@test",
+					},
+				)
+				assert.NoError(t, err)
+				tokenString, err := retriever.GetToken("foo")
+				assert.NoError(t, err)
+
+				token, _, err := jwt.NewParser().ParseUnverified(tokenString, jwt.MapClaims{})
+				assert.NoError(t, err)
+				assert.Equal(t, tt.method, token.Header["alg"])
+
+				expectedClaims := ValidatableMapClaims{"aud": "foo"}
+				manager := NewManualKeyManager(tt.publicKey, &expectedClaims)
+				v, err := manager.Validate(tokenString)
+				assert.NoError(t, err)
+				assert.True(t, v)
+			},
+		)
+	}
+
+	// The curve of an EC key must match the signing method.
+	retriever := new(ManualTokenRetriever)
+	err = retriever.Configure(
+		&ManualTokenConfig{
+			Key:           sec1(p256Key),
+			SigningMethod: "ES384",
+			Issuer:        "https://foo",
+			Subject:       "foo@test",
+		},
+	)
+	assert.Error(t, err)
+}
+
+func TestManualTokenRetriever_Options(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	b, err := x509.MarshalECPrivateKey(ecKey)
+	assert.NoError(t, err)
+	keyPem := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}))
+
+	retriever := new(ManualTokenRetriever)
+	err = retriever.Configure(
+		&ManualTokenConfig{
+			Key:               keyPem,
+			SigningMethod:     "ES256",
+			Issuer:            "https://foo",
+			Subject:           "foo@test",
+			Lifetime:          5 * time.Minute,
+			NotBeforeBackdate: 30 * time.Second,
+			KeyIdThumbprint:   true,
+			TokenId:           true,
+		},
+	)
+	assert.NoError(t, err)
+
+	parse := func() (*jwt.Token, jwt.MapClaims) {
+		tokenString, err := retriever.GetToken("foo")
+		assert.NoError(t, err)
+		claims := jwt.MapClaims{}
+		token, _, err := jwt.NewParser().ParseUnverified(tokenString, claims)
+		assert.NoError(t, err)
+		return token, claims
+	}
+
+	token, claims := parse()
+	thumbprint, err := jwkThumbprint(&ecKey.PublicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, thumbprint, token.Header["kid"])
+	assert.Equal(t, float64(300), claims["exp"].(float64)-claims["iat"].(float64))
+	assert.Equal(t, float64(30), claims["iat"].(float64)-claims["nbf"].(float64))
+
+	// Each token has a unique ID.
+	_, otherClaims := parse()
+	assert.NotEmpty(t, claims["jti"])
+	assert.NotEqual(t, claims["jti"], otherClaims["jti"])
+
+	err = retriever.Configure(
+		&ManualTokenConfig{
+			Key:           "testing",
+			SigningMethod: "HS256",
+			Issuer:        "https://foo",
+			Subject:       "foo@test",
+			KeyId:         "test-key",
+		},
+	)
+	assert.NoError(t, err)
+	token, claims = parse()
+	assert.Equal(t, "test-key", token.Header["kid"])
+	assert.Equal(t, float64(3600), claims["exp"].(float64)-claims["iat"].(float64))
+	assert.NotContains(t, claims, "nbf")
+	assert.NotContains(t, claims, "jti")
+
+	// The jti and nbf claims may be specified as additional claims when they
+	// are not set by the token retriever.
+	err = retriever.Configure(
+		&ManualTokenConfig{
+			Key:           "testing",
+			SigningMethod: "HS256",
+			Issuer:        "https://foo",
+			Subject:       "foo@test",
+			Claims:        `{"jti": "fixed", "nbf": 1}`,
+		},
+	)
+	assert.NoError(t, err)
+	_, claims = parse()
+	assert.Equal(t, "fixed", claims["jti"])
+	assert.Equal(t, float64(1), claims["nbf"])
+
+	// Thumbprints are not derived from symmetric keys.
+	err = retriever.Configure(
+		&ManualTokenConfig{
+			Key:             "testing",
+			SigningMethod:   "HS256",
+			Issuer:          "https://foo",
+			Subject:         "foo@test",
+			KeyIdThumbprint: true,
+		},
+	)
+	assert.Error(t, err)
+}
+
+func TestManualTokenRetriever_Jwks(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	keyPem := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+
+	retriever := new(ManualTokenRetriever)
+	err = retriever.Configure(
+		&ManualTokenConfig{
+			Key:           keyPem,
+			SigningMethod: "RS256",
+			Issuer:        "https://foo",
+			Subject:       "foo@test",
+		},
+	)
+	assert.NoError(t, err)
+	_, err = retriever.Jwks()
+	assert.ErrorContains(t, err, "key ID is required")
+
+	retriever.keyId = "test-key"
+	jwks, err := retriever.Jwks()
+	assert.NoError(t, err)
+	assert.Len(t, jwks.Keys, 1)
+	assert.Equal(t, "test-key", jwks.Keys[0]["kid"])
+	assert.Equal(t, "RS256", jwks.Keys[0]["alg"])
+	assert.Equal(t, "RSA", jwks.Keys[0]["kty"])
+	assert.Equal(t, "AQAB", jwks.Keys[0]["e"])
+
+	err = retriever.Configure(
+		&ManualTokenConfig{
+			Key:           "testing",
+			SigningMethod: "HS256",
+			Issuer:        "https://foo",
+			Subject:       "foo@test",
+			KeyId:         "test-key",
+		},
+	)
+	assert.NoError(t, err)
+	_, err = retriever.Jwks()
+	assert.ErrorContains(t, err, "asymmetric")
+}
+
+func TestManualTokenRetriever_Keyring(t *testing.T) {
+	pemKey := func() string {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NoError(t, err)
+		b, err := x509.MarshalECPrivateKey(key)
+		assert.NoError(t, err)
+		return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}))
+	}
+
+	dir := t.TempDir()
+	now := time.Now().UTC()
+	writeKey := func(kid string, notBefore time.Time) {
+		b, err := yaml.Marshal(keyringEntry{KeyId: kid, Key: pemKey(), NotBefore: notBefore})
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, kid+".yaml"), b, 0600))
+	}
+	writeKey("first", now.Add(-time.Hour))
+	writeKey("second", now.Add(time.Hour))
+
+	retriever := new(ManualTokenRetriever)
+	err := retriever.Configure(
+		&ManualTokenConfig{
+			Keyring:        dir,
+			ReloadInterval: 10 * time.Millisecond,
+			SigningMethod:  "ES256",
+			Issuer:         "https://foo",
+			Subject:        "foo@test",
+		},
+	)
+	assert.NoError(t, err)
+	defer retriever.watcher.Stop()
+
+	kid := func() string {
+		token, err := retriever.GetToken("test-svc")
+		assert.NoError(t, err)
+		parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+		assert.NoError(t, err)
+		return parsed.Header["kid"].(string)
+	}
+	assert.Equal(t, "first", kid())
+
+	jwks, err := retriever.Jwks()
+	assert.NoError(t, err)
+	assert.Len(t, jwks.Keys, 2)
+
+	writeKey("third", now.Add(-time.Minute))
+	assert.Eventually(
+		t, func() bool {
+			return kid() == "third"
+		}, time.Second, 10*time.Millisecond,
+	)
+
+	err = new(ManualTokenRetriever).Configure(
+		&ManualTokenConfig{
+			Keyring:       dir,
+			Key:           pemKey(),
+			SigningMethod: "ES256",
+			Issuer:        "https://foo",
+			Subject:       "foo@test",
+		},
+	)
+	assert.ErrorContains(t, err, "must not be specified with a keyring")
+}
+
+func TestManualKeyManager_Keyring(t *testing.T) {
+	keyringPath := filepath.Join(t.TempDir(), "keyring.json")
+	err := os.WriteFile(keyringPath, []byte(`[{"kid": "first", "key": "first-secret"}]`), 0600)
+	assert.NoError(t, err)
+
+	expectedClaims := ValidatableMapClaims{
+		"aud": "test-svc",
+	}
+	detect := func(b []byte) (interface{}, error) {
+		if string(b) == "ed25519" {
+			return ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)), nil
+		}
+		return b, nil
+	}
+	manager, err := NewManualKeyringManager(keyringPath, 10*time.Millisecond, detect, &expectedClaims)
+	assert.NoError(t, err)
+	defer manager.watcher.Stop()
+
+	sign := func(kid string, key string) string {
+		token := jwt.NewWithClaims(
+			jwt.SigningMethodHS256, jwt.MapClaims{
+				"iss": "https://foo",
+				"sub": "foo@test",
+				"aud": "test-svc",
+				"iat": time.Now().Unix(),
+				"exp": time.Now().Add(time.Hour).Unix(),
+			},
+		)
+		token.Header["kid"] = kid
+		s, err := token.SignedString([]byte(key))
+		assert.NoError(t, err)
+		return s
+	}
+
+	v, err := manager.Validate(sign("first", "first-secret"))
+	assert.True(t, v)
+	assert.NoError(t, err)
+
+	v, err = manager.Validate(sign("second", "second-secret"))
+	assert.False(t, v)
+	assert.ErrorContains(t, err, "unknown key ID")
+
+	err = os.WriteFile(
+		keyringPath,
+		[]byte(`[{"kid": "first", "key": "first-secret"}, {"kid": "second", "key": "second-secret"}]`), 0600,
+	)
+	assert.NoError(t, err)
+	assert.Eventually(
+		t, func() bool {
+			v, _ := manager.Validate(sign("second", "second-secret"))
+			return v
+		}, time.Second, 10*time.Millisecond,
+	)
+
+	// A key ID that changes to a different type of key is rejected, and the
+	// previous keyring is kept.
+	err = os.WriteFile(keyringPath, []byte(`[{"kid": "first", "key": "ed25519"}]`), 0600)
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	v, err = manager.Validate(sign("second", "second-secret"))
+	assert.True(t, v)
+	assert.NoError(t, err)
+}
+
+func TestManualTokenRetriever_KeyFile(t *testing.T) {
+	pemKey := func() (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NoError(t, err)
+		b, err := x509.MarshalECPrivateKey(key)
+		assert.NoError(t, err)
+		thumbprint, err := jwkThumbprint(key)
+		assert.NoError(t, err)
+		return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})), thumbprint
+	}
+
+	keyPath := filepath.Join(t.TempDir(), "key.pem")
+	firstKey, firstThumbprint := pemKey()
+	err := os.WriteFile(keyPath, []byte(firstKey), 0600)
+	assert.NoError(t, err)
+
+	retriever := new(ManualTokenRetriever)
+	err = retriever.Configure(
+		&ManualTokenConfig{
+			KeyFile:         keyPath,
+			ReloadInterval:  10 * time.Millisecond,
+			KeyIdThumbprint: true,
+			SigningMethod:   "ES256",
+			Issuer:          "https://foo",
+			Subject:         "foo@test",
+		},
+	)
+	assert.NoError(t, err)
+	defer func() { retriever.watcher.Stop() }()
+
+	kid := func() string {
+		token, err := retriever.GetToken("test-svc")
+		assert.NoError(t, err)
+		parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+		assert.NoError(t, err)
+		return parsed.Header["kid"].(string)
+	}
+	assert.Equal(t, firstThumbprint, kid())
+
+	secondKey, secondThumbprint := pemKey()
+	err = os.WriteFile(keyPath, []byte(secondKey), 0600)
+	assert.NoError(t, err)
+	assert.Eventually(
+		t, func() bool {
+			return kid() == secondThumbprint
+		}, time.Second, 10*time.Millisecond,
+	)
+
+	// After reconfiguring with a different key file, changes to the previous
+	// key file are not used.
+	otherPath := filepath.Join(t.TempDir(), "other.pem")
+	otherKey, otherThumbprint := pemKey()
+	err = os.WriteFile(otherPath, []byte(otherKey), 0600)
+	assert.NoError(t, err)
+	err = retriever.Configure(
+		&ManualTokenConfig{
+			KeyFile:         otherPath,
+			ReloadInterval:  10 * time.Millisecond,
+			KeyIdThumbprint: true,
+			SigningMethod:   "ES256",
+			Issuer:          "https://foo",
+			Subject:         "foo@test",
+		},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, otherThumbprint, kid())
+	thirdKey, _ := pemKey()
+	err = os.WriteFile(keyPath, []byte(thirdKey), 0600)
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, otherThumbprint, kid())
+
+	err = new(ManualTokenRetriever).Configure(
+		&ManualTokenConfig{
+			KeyFile:       filepath.Join(t.TempDir(), "missing.pem"),
+			SigningMethod: "ES256",
+			Issuer:        "https://foo",
+			Subject:       "foo@test",
+		},
+	)
+	assert.ErrorContains(t, err, "unable to read file")
+}
@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Oauth2TokenRetriever is an implementation of JwtTokenRetriever for tokens
+// obtained using the OAuth 2.0 client credentials grant. The ID token, or a
+// JWT access token, from the token response is returned.
+type Oauth2TokenRetriever struct {
+	tokenUrl          string
+	clientId          string
+	clientSecret      string
+	authMethod        string
+	scope             string
+	audienceParameter string
+	assertion         *ManualTokenRetriever
+}
+
+// An Oauth2TokenConfig contains configuration data used to initialize and
+// validate an Oauth2TokenRetriever object.
+type Oauth2TokenConfig struct {
+	TokenUrl          string `long:"token-url" env:"TOKEN_URL" description:"OAuth 2.0 token endpoint URL"`
+	ClientId          string `long:"client-id" env:"CLIENT_ID" description:"OAuth 2.0 client ID"`
+	ClientSecret      string `long:"client-secret" env:"CLIENT_SECRET" description:"OAuth 2.0 client secret"`
+	AuthMethod        string `long:"auth-method" env:"AUTH_METHOD" description:"Client authentication method" choice:"client_secret_basic" choice:"client_secret_post" choice:"private_key_jwt" default:"client_secret_basic"`
+	SigningKey        string `long:"signing-key" env:"SIGNING_KEY" description:"Private key for private_key_jwt client authentication"`
+	SigningMethod     string `long:"signing-method" env:"SIGNING_METHOD" description:"Signing method for private_key_jwt client authentication" default:"RS256"`
+	Scope             string `long:"scope" env:"SCOPE" description:"Space separated scopes to request"`
+	AudienceParameter string `long:"audience-parameter" env:"AUDIENCE_PARAMETER" description:"Token request parameter used to send the audience" default:"audience"`
+}
+
+// oauth2TokenResponse is a successful or unsuccessful response from an OAuth
+// 2.0 token endpoint.
+type oauth2TokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	IdToken          string `json:"id_token"`
+	IssuedTokenType  string `json:"issued_token_type"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// GetToken performs a client credentials grant for the audience.
+func (r *Oauth2TokenRetriever) GetToken(aud string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if r.scope != "" {
+		form.Set("scope", r.scope)
+	}
+	if r.audienceParameter != "" {
+		form.Set(r.audienceParameter, aud)
+	}
+
+	tokenResponse, err := r.requestToken(form)
+	if err != nil {
+		return "", err
+	}
+
+	return tokenResponse.jwt()
+}
+
+// requestToken authenticates the client and sends a token request to the
+// token endpoint.
+func (r *Oauth2TokenRetriever) requestToken(form url.Values) (*oauth2TokenResponse, error) {
+	client := http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	switch r.authMethod {
+	case "client_secret_post":
+		form.Set("client_id", r.clientId)
+		form.Set("client_secret", r.clientSecret)
+	case "private_key_jwt":
+		assertion, err := r.clientAssertion()
+		if err != nil {
+			return nil, fmt.Errorf("unable to create client assertion: %w", err)
+		}
+		form.Set("client_id", r.clientId)
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", assertion)
+	}
+
+	req, err := http.NewRequest("POST", r.tokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("error creating token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if r.authMethod == "client_secret_basic" {
+		req.SetBasicAuth(url.QueryEscape(r.clientId), url.QueryEscape(r.clientSecret))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenResponse := oauth2TokenResponse{}
+	err = json.Unmarshal(body, &tokenResponse)
+	if resp.StatusCode != 200 {
+		if err == nil && tokenResponse.Error != "" {
+			return nil, fmt.Errorf("unsuccessful status code while fetching token: %v, %v: %v", resp.StatusCode, tokenResponse.Error, tokenResponse.ErrorDescription)
+		}
+		return nil, fmt.Errorf("unsuccessful status code while fetching token: %v, %v", resp.StatusCode, string(body))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode token response: %w", err)
+	}
+
+	return &tokenResponse, nil
+}
+
+// clientAssertion returns a signed JWT for private_key_jwt client
+// authentication, as described in RFC 7523.
+func (r *Oauth2TokenRetriever) clientAssertion() (string, error) {
+	jti, err := randomId()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	return r.assertion.signClaims(
+		jwt.MapClaims{
+			"iss": r.clientId,
+			"sub": r.clientId,
+			"aud": r.tokenUrl,
+			"jti": jti,
+			"iat": now.Unix(),
+			"exp": now.Add(5 * time.Minute).Unix(),
+		},
+	)
+}
+
+// Configure will take a valid Oauth2TokenConfig and use it to configure the token retriever.
+func (r *Oauth2TokenRetriever) Configure(config interface{}) error {
+	c, ok := config.(*Oauth2TokenConfig)
+	if !ok {
+		log.Fatalln("internal error: incorrect token config")
+	}
+	if c.TokenUrl == "" {
+		return errors.New("token URL must not be empty")
+	}
+	if c.ClientId == "" {
+		return errors.New("client ID must not be empty")
+	}
+
+	switch c.AuthMethod {
+	case "client_secret_basic", "client_secret_post":
+		if c.ClientSecret == "" {
+			return errors.New("client secret must not be empty")
+		}
+	case "private_key_jwt":
+		r.assertion = new(ManualTokenRetriever)
+		err := r.assertion.Configure(
+			&ManualTokenConfig{
+				Issuer:        c.ClientId,
+				Subject:       c.ClientId,
+				Key:           c.SigningKey,
+				SigningMethod: c.SigningMethod,
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("unable to configure client assertion signing: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown client authentication method: %v", c.AuthMethod)
+	}
+
+	r.tokenUrl = c.TokenUrl
+	r.clientId = c.ClientId
+	r.clientSecret = c.ClientSecret
+	r.authMethod = c.AuthMethod
+	r.scope = c.Scope
+	r.audienceParameter = c.AudienceParameter
+	return nil
+}
+
+// jwt returns the ID token from the token response, or the access token if
+// it is a JWT.
+func (t *oauth2TokenResponse) jwt() (string, error) {
+	if t.IdToken != "" {
+		return t.IdToken, nil
+	}
+	if t.AccessToken == "" {
+		return "", errors.New("token response did not contain an ID token or access token")
+	}
+
+	_, _, err := jwt.NewParser().ParseUnverified(t.AccessToken, jwt.MapClaims{})
+	if err != nil {
+		return "", errors.New("token response did not contain an ID token and the access token is not a JWT")
+	}
+	return t.AccessToken, nil
+}
+
+// randomId returns a random 128-bit identifier encoded as hex.
+func randomId() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("unable to generate random identifier: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
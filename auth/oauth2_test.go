@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOauth2TokenRetriever(t *testing.T) {
+	pubKey, err := jwt.ParseRSAPublicKeyFromPEM([]byte(publicKey))
+	assert.NoError(t, err)
+
+	var tokenUrl string
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(rw http.ResponseWriter, r *http.Request) {
+				assert.NoError(t, r.ParseForm())
+				assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+
+				authenticated := false
+				if clientId, clientSecret, ok := r.BasicAuth(); ok {
+					authenticated = clientId == "test-client" && clientSecret == "test-secret"
+				} else if r.PostForm.Get("client_secret") != "" {
+					authenticated = r.PostForm.Get("client_id") == "test-client" && r.PostForm.Get("client_secret") == "test-secret"
+				} else if assertion := r.PostForm.Get("client_assertion"); assertion != "" {
+					claims := jwt.MapClaims{}
+					_, err := jwt.ParseWithClaims(
+						assertion, claims, func(token *jwt.Token) (interface{}, error) {
+							return pubKey, nil
+						}, jwt.WithAudience(tokenUrl), jwt.WithIssuer("test-client"), jwt.WithSubject("test-client"),
+					)
+					authenticated = err == nil && claims["jti"] != nil
+				}
+				if !authenticated {
+					rw.WriteHeader(http.StatusUnauthorized)
+					_ = json.NewEncoder(rw).Encode(oauth2TokenResponse{Error: "invalid_client"})
+					return
+				}
+
+				token := newTestToken(t, r.PostForm.Get("resource"), "test-client")
+				_ = json.NewEncoder(rw).Encode(oauth2TokenResponse{AccessToken: token})
+			},
+		),
+	)
+	defer server.Close()
+	tokenUrl = server.URL + "/token"
+
+	tests := []struct {
+		name    string
+		config  Oauth2TokenConfig
+		success bool
+	}{
+		{
+			name: "client secret basic",
+			config: Oauth2TokenConfig{
+				ClientSecret: "test-secret",
+				AuthMethod:   "client_secret_basic",
+			},
+			success: true,
+		},
+		{
+			name: "client secret post",
+			config: Oauth2TokenConfig{
+				ClientSecret: "test-secret",
+				AuthMethod:   "client_secret_post",
+			},
+			success: true,
+		},
+		{
+			name: "private key jwt",
+			config: Oauth2TokenConfig{
+				AuthMethod:    "private_key_jwt",
+				SigningKey:    privateKey,
+				SigningMethod: "RS256",
+			},
+			success: true,
+		},
+		{
+			name: "invalid client secret",
+			config: Oauth2TokenConfig{
+				ClientSecret: "wrong-secret",
+				AuthMethod:   "client_secret_basic",
+			},
+			success: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				tt.config.TokenUrl = tokenUrl
+				tt.config.ClientId = "test-client"
+				tt.config.AudienceParameter = "resource"
+
+				retriever := new(Oauth2TokenRetriever)
+				err := retriever.Configure(&tt.config)
+				assert.NoError(t, err)
+
+				token, err := retriever.GetToken("test-svc")
+				if tt.success {
+					assert.NoError(t, err)
+					assert.NoError(t, checkTokenAudience(token, "test-svc"))
+				} else {
+					assert.ErrorContains(t, err, "invalid_client")
+				}
+			},
+		)
+	}
+}
+
+func TestOauth2TokenResponse_Jwt(t *testing.T) {
+	token := newTestToken(t, "test-svc", "test-client")
+
+	res, err := (&oauth2TokenResponse{IdToken: token, AccessToken: "opaque"}).jwt()
+	assert.NoError(t, err)
+	assert.Equal(t, token, res)
+
+	res, err = (&oauth2TokenResponse{AccessToken: token}).jwt()
+	assert.NoError(t, err)
+	assert.Equal(t, token, res)
+
+	_, err = (&oauth2TokenResponse{AccessToken: "opaque"}).jwt()
+	assert.Error(t, err)
+}
@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// SpiffeTokenRetriever is an implementation of JwtTokenRetriever for
+// JWT-SVIDs fetched from the SPIFFE Workload API.
+type SpiffeTokenRetriever struct {
+	client   *workloadapi.Client
+	spiffeId spiffeid.ID
+}
+
+// A SpiffeTokenConfig contains configuration data used to initialize and
+// validate a SpiffeTokenRetriever object.
+type SpiffeTokenConfig struct {
+	SocketPath string `long:"socket-path" env:"SOCKET_PATH" description:"SPIFFE Workload API socket address (defaults to SPIFFE_ENDPOINT_SOCKET)"`
+	SpiffeId   string `long:"id" env:"ID" description:"SPIFFE ID to request when the workload has several identities"`
+}
+
+// A SpiffeKeyManager implements the KeyManager interface and validates
+// JWT-SVIDs using the JWT bundles provided by the SPIFFE Workload API.
+type SpiffeKeyManager struct {
+	source         *workloadapi.JWTSource
+	matcher        spiffeid.Matcher
+	expectedClaims *ValidatableMapClaims
+}
+
+// GetToken fetches a new JWT-SVID for the audience from the Workload API.
+func (r *SpiffeTokenRetriever) GetToken(aud string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	svid, err := r.client.FetchJWTSVID(
+		ctx, jwtsvid.Params{
+			Audience: aud,
+			Subject:  r.spiffeId,
+		},
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch JWT-SVID: %w", err)
+	}
+
+	return svid.Marshal(), nil
+}
+
+// Configure will take a valid SpiffeTokenConfig and use it to configure the token retriever.
+func (r *SpiffeTokenRetriever) Configure(config interface{}) error {
+	c, ok := config.(*SpiffeTokenConfig)
+	if !ok {
+		log.Fatalln("internal error: incorrect token config")
+	}
+
+	if c.SpiffeId != "" {
+		id, err := spiffeid.FromString(c.SpiffeId)
+		if err != nil {
+			return fmt.Errorf("invalid SPIFFE ID: %w", err)
+		}
+		r.spiffeId = id
+	}
+
+	// The Workload API client connects lazily, so check for the socket to
+	// report an unavailable Workload API when the retriever is configured.
+	addr := c.SocketPath
+	if addr == "" {
+		addr, _ = workloadapi.GetDefaultAddress()
+	}
+	if addr == "" {
+		return unavailable(errors.New("SPIFFE Workload API socket address or SPIFFE_ENDPOINT_SOCKET must be specified"))
+	}
+	if path, ok := spiffeSocketPath(addr); ok {
+		_, err := os.Stat(path)
+		if err != nil {
+			return unavailable(fmt.Errorf("unable to find Workload API socket: %w", err))
+		}
+	}
+
+	client, err := workloadapi.New(context.Background(), spiffeClientOptions(c.SocketPath)...)
+	if err != nil {
+		return unavailable(fmt.Errorf("unable to create Workload API client: %w", err))
+	}
+	r.client = client
+
+	return nil
+}
+
+// Validate will parse and validate a JWT-SVID, its SPIFFE ID and its claims.
+func (m *SpiffeKeyManager) Validate(tok string) (bool, error) {
+	aud, ok := (*m.expectedClaims)["aud"].(string)
+	if !ok {
+		return false, errors.New("internal error: audience claim was missing from expected claims")
+	}
+
+	svid, err := jwtsvid.ParseAndValidate(tok, m.source, []string{aud})
+	if err != nil {
+		return false, err
+	}
+
+	err = m.matcher(svid.ID)
+	if err != nil {
+		return false, fmt.Errorf("SPIFFE ID was not valid: %w", err)
+	}
+
+	// The audience has already been validated against the JWT-SVID, and
+	// JWT-SVIDs are not required to include all OIDC ID token claims.
+	expectedClaims := ValidatableMapClaims{}
+	for k, v := range *m.expectedClaims {
+		if k != "aud" {
+			expectedClaims[k] = v
+		}
+	}
+	claims := jwt.MapClaims(svid.Claims)
+	return expectedClaims.matchClaims(&claims)
+}
+
+// NewSpiffeKeyManager returns a new SpiffeKeyManager that fetches JWT
+// bundles from the Workload API at socketPath. JWT-SVIDs must have the
+// SPIFFE ID spiffeId, or be a member of trustDomain, when either is set.
+func NewSpiffeKeyManager(socketPath string, spiffeId string, trustDomain string, claims *ValidatableMapClaims) *SpiffeKeyManager {
+	m := SpiffeKeyManager{
+		matcher:        spiffeid.MatchAny(),
+		expectedClaims: claims,
+	}
+
+	if spiffeId != "" {
+		id, err := spiffeid.FromString(spiffeId)
+		if err != nil {
+			log.Fatalf("invalid SPIFFE ID %q: %s", spiffeId, err)
+		}
+		m.matcher = spiffeid.MatchID(id)
+	} else if trustDomain != "" {
+		td, err := spiffeid.TrustDomainFromString(trustDomain)
+		if err != nil {
+			log.Fatalf("invalid SPIFFE trust domain %q: %s", trustDomain, err)
+		}
+		m.matcher = spiffeid.MatchMemberOf(td)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	source, err := workloadapi.NewJWTSource(
+		ctx, workloadapi.WithClientOptions(spiffeClientOptions(socketPath)...),
+	)
+	if err != nil {
+		log.Fatalf("failed to fetch JWT bundles from the Workload API: %s", err)
+	}
+	m.source = source
+
+	return &m
+}
+
+// spiffeSocketPath returns the path of a unix socket Workload API address,
+// and reports whether the address is a unix socket.
+func spiffeSocketPath(addr string) (string, bool) {
+	u, err := url.Parse(addr)
+	if err != nil || u.Scheme != "unix" {
+		return "", false
+	}
+	if u.Opaque != "" {
+		return u.Opaque, true
+	}
+	return u.Path, true
+}
+
+// spiffeClientOptions returns the Workload API client options for the socket
+// address. When empty, the SPIFFE_ENDPOINT_SOCKET environment variable is
+// used by the client.
+func spiffeClientOptions(socketPath string) []workloadapi.ClientOption {
+	if socketPath == "" {
+		return nil
+	}
+	return []workloadapi.ClientOption{workloadapi.WithAddr(socketPath)}
+}
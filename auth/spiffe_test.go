@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+// fakeWorkloadApi is a minimal SPIFFE Workload API server that issues
+// JWT-SVIDs and serves the JWT bundle for a single trust domain.
+type fakeWorkloadApi struct {
+	workload.UnimplementedSpiffeWorkloadAPIServer
+	key      *ecdsa.PrivateKey
+	keyId    string
+	spiffeId string
+}
+
+func (f *fakeWorkloadApi) FetchJWTSVID(_ context.Context, req *workload.JWTSVIDRequest) (*workload.JWTSVIDResponse, error) {
+	token := jwt.NewWithClaims(
+		jwt.SigningMethodES256, jwt.MapClaims{
+			"aud": req.Audience,
+			"iss": "https://spiffe.test",
+			"sub": f.spiffeId,
+			"iat": time.Now().Unix(),
+			"exp": time.Now().Add(time.Hour).Unix(),
+		},
+	)
+	token.Header["kid"] = f.keyId
+	tokenString, err := token.SignedString(f.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &workload.JWTSVIDResponse{
+		Svids: []*workload.JWTSVID{{SpiffeId: f.spiffeId, Svid: tokenString}},
+	}, nil
+}
+
+func (f *fakeWorkloadApi) FetchJWTBundles(_ *workload.JWTBundlesRequest, stream grpc.ServerStreamingServer[workload.JWTBundlesResponse]) error {
+	td := spiffeid.RequireTrustDomainFromString("spiffe.test")
+	bundle := jwtbundle.New(td)
+	err := bundle.AddJWTAuthority(f.keyId, f.key.Public())
+	if err != nil {
+		return err
+	}
+	b, err := bundle.Marshal()
+	if err != nil {
+		return err
+	}
+
+	err = stream.Send(&workload.JWTBundlesResponse{Bundles: map[string][]byte{td.IDString(): b}})
+	if err != nil {
+		return err
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+func startFakeWorkloadApi(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	socketPath := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socketPath)
+	assert.NoError(t, err)
+
+	server := grpc.NewServer()
+	workload.RegisterSpiffeWorkloadAPIServer(
+		server, &fakeWorkloadApi{
+			key:      key,
+			keyId:    "test-key",
+			spiffeId: "spiffe://spiffe.test/workload",
+		},
+	)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+
+	return "unix://" + socketPath
+}
+
+func TestSpiffe(t *testing.T) {
+	socketPath := startFakeWorkloadApi(t)
+
+	retriever := new(SpiffeTokenRetriever)
+	err := retriever.Configure(&SpiffeTokenConfig{SocketPath: socketPath})
+	assert.NoError(t, err)
+	defer retriever.client.Close()
+
+	tokenString, err := retriever.GetToken("test-svc")
+	assert.NoError(t, err)
+
+	// Without a Workload API socket, the auth type is unavailable.
+	err = new(SpiffeTokenRetriever).Configure(
+		&SpiffeTokenConfig{SocketPath: "unix://" + filepath.Join(t.TempDir(), "missing.sock")},
+	)
+	assert.ErrorIs(t, err, ErrUnavailable)
+	t.Setenv("SPIFFE_ENDPOINT_SOCKET", "")
+	err = new(SpiffeTokenRetriever).Configure(&SpiffeTokenConfig{})
+	assert.ErrorIs(t, err, ErrUnavailable)
+
+	path, ok := spiffeSocketPath("unix:/run/spire/agent.sock")
+	assert.True(t, ok)
+	assert.Equal(t, "/run/spire/agent.sock", path)
+	_, ok = spiffeSocketPath("tcp://127.0.0.1:8081")
+	assert.False(t, ok)
+
+	tests := []struct {
+		name        string
+		spiffeId    string
+		trustDomain string
+		claims      ValidatableMapClaims
+		success     bool
+	}{
+		{
+			name:     "matching SPIFFE ID",
+			spiffeId: "spiffe://spiffe.test/workload",
+			claims:   ValidatableMapClaims{"aud": "test-svc"},
+			success:  true,
+		},
+		{
+			name:        "matching trust domain",
+			trustDomain: "spiffe.test",
+			claims:      ValidatableMapClaims{"aud": "test-svc"},
+			success:     true,
+		},
+		{
+			name:     "mismatched SPIFFE ID",
+			spiffeId: "spiffe://spiffe.test/other",
+			claims:   ValidatableMapClaims{"aud": "test-svc"},
+			success:  false,
+		},
+		{
+			name:        "mismatched trust domain",
+			trustDomain: "other.test",
+			claims:      ValidatableMapClaims{"aud": "test-svc"},
+			success:     false,
+		},
+		{
+			name:    "mismatched audience",
+			claims:  ValidatableMapClaims{"aud": "other-svc"},
+			success: false,
+		},
+		{
+			name:    "mismatched claim",
+			claims:  ValidatableMapClaims{"aud": "test-svc", "iss": "https://other.test"},
+			success: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				manager := NewSpiffeKeyManager(socketPath, tt.spiffeId, tt.trustDomain, &tt.claims)
+				defer manager.source.Close()
+
+				v, err := manager.Validate(tokenString)
+				if tt.success {
+					assert.True(t, v)
+					assert.NoError(t, err)
+				} else {
+					assert.False(t, v)
+					assert.Error(t, err)
+				}
+			},
+		)
+	}
+}
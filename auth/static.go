@@ -4,31 +4,41 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
 // A StaticTokenRetriever implements the JwtTokenRetriever interface for use with tokens
-// that are provided by the user and never updated.
+// that are provided by the user. A token read from a file is updated when the
+// file changes.
 type StaticTokenRetriever struct {
-	token string
+	mu      sync.RWMutex
+	token   string
+	watcher *fileWatcher
 }
 
 // A StaticTokenConfig contains configuration data used to initialize and
 // validate a StaticTokenRetriever object.
 type StaticTokenConfig struct {
-	Token string `long:"token" env:"TOKEN" description:"Static authentication identity token"`
+	Token          string        `long:"token" env:"TOKEN" description:"Static authentication identity token"`
+	TokenFile      string        `long:"token-file" env:"TOKEN_FILE" description:"Path to a file containing the static authentication identity token"`
+	ReloadInterval time.Duration `long:"reload-interval" env:"RELOAD_INTERVAL" description:"Interval for checking the token file for changes" default:"30s"`
 }
 
 // A StaticKeyManager implements the KeyManager interface and supports a
 // static JWT for validation.
 type StaticKeyManager struct {
+	mu             sync.RWMutex
 	token          interface{}
 	expectedClaims *ValidatableMapClaims
 }
 
 // GetToken returns the configured static token.
 func (r *StaticTokenRetriever) GetToken(_ string) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.token, nil
 }
 
@@ -39,10 +49,32 @@ func (r *StaticTokenRetriever) Configure(config interface{}) error {
 		log.Fatalln("internal error: incorrect Token config")
 	}
 
-	if c.Token == "" {
+	if c.Token == "" && c.TokenFile == "" {
 		return errors.New("static JWT Token must not be empty")
 	}
-	r.token = c.Token
+
+	// Stop watching a token file from a previous configuration, so that it
+	// does not replace the token from the new configuration.
+	r.watcher.Stop()
+	r.watcher = nil
+
+	watcher, err := watchSecret(c.Token, c.TokenFile, c.ReloadInterval, r.setToken)
+	if err != nil {
+		return err
+	}
+	r.watcher = watcher
+	return nil
+}
+
+// setToken replaces the static token.
+func (r *StaticTokenRetriever) setToken(b []byte) error {
+	if len(b) == 0 {
+		return errors.New("static JWT Token must not be empty")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.token = string(b)
 	return nil
 }
 
@@ -53,12 +85,23 @@ func (m *StaticKeyManager) Validate(tok string) (bool, error) {
 	if err != nil {
 		return false, fmt.Errorf("error parsing token: %w", err)
 	}
-	if tok == m.token {
+	m.mu.RLock()
+	token := m.token
+	m.mu.RUnlock()
+	if tok == token {
 		return m.expectedClaims.ValidateClaims(&claims)
 	}
 	return false, errors.New("static token did not match")
 }
 
+// SetToken replaces the static token. It is safe to call SetToken while
+// tokens are being validated.
+func (m *StaticKeyManager) SetToken(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.token = token
+}
+
 // NewStaticKeyManager returns a new StaticKeyManager for the static token
 // provided.
 func NewStaticKeyManager(token interface{}, claims *ValidatableMapClaims) *StaticKeyManager {
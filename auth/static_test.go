@@ -1,7 +1,10 @@
 package auth
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -20,3 +23,46 @@ func TestStaticKeyManager(t *testing.T) {
 	assert.True(t, v)
 	assert.Nil(t, err)
 }
+
+func TestStaticTokenRetriever_File(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	firstToken := newTestToken(t, "test-svc", "first")
+	err := os.WriteFile(tokenPath, []byte(firstToken+"\n"), 0600)
+	assert.NoError(t, err)
+
+	retriever := new(StaticTokenRetriever)
+	err = retriever.Configure(
+		&StaticTokenConfig{
+			TokenFile:      tokenPath,
+			ReloadInterval: 10 * time.Millisecond,
+		},
+	)
+	assert.NoError(t, err)
+	defer func() { retriever.watcher.Stop() }()
+
+	token, err := retriever.GetToken("test-svc")
+	assert.NoError(t, err)
+	assert.Equal(t, firstToken, token)
+
+	secondToken := newTestToken(t, "test-svc", "second")
+	err = os.WriteFile(tokenPath, []byte(secondToken), 0600)
+	assert.NoError(t, err)
+	assert.Eventually(
+		t, func() bool {
+			token, err := retriever.GetToken("test-svc")
+			return err == nil && token == secondToken
+		}, time.Second, 10*time.Millisecond,
+	)
+
+	// After reconfiguring with an inline token, changes to the token file are
+	// not used.
+	inlineToken := newTestToken(t, "test-svc", "inline")
+	err = retriever.Configure(&StaticTokenConfig{Token: inlineToken})
+	assert.NoError(t, err)
+	err = os.WriteFile(tokenPath, []byte(newTestToken(t, "test-svc", "third")), 0600)
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	token, err = retriever.GetToken("test-svc")
+	assert.NoError(t, err)
+	assert.Equal(t, inlineToken, token)
+}
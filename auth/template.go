@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// claimTemplateFuncs are the functions available in templated claim values.
+// The header function is replaced with one that reads the incoming request
+// when a template is executed.
+var claimTemplateFuncs = template.FuncMap{
+	"header":   func(string) string { return "" },
+	"env":      os.Getenv,
+	"hostname": os.Hostname,
+}
+
+// parseClaimTemplates returns the claims with a string value containing a
+// template action, including strings nested in maps and arrays. In the
+// returned claims, each of these strings is replaced with its parsed template.
+// Claims without template actions are not included.
+func parseClaimTemplates(claims map[string]interface{}) (map[string]interface{}, error) {
+	templates := make(map[string]interface{})
+	for k, v := range claims {
+		t, ok, err := parseClaimTemplate(k, v)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			templates[k] = t
+		}
+	}
+
+	return templates, nil
+}
+
+// parseClaimTemplate parses the templates in the value of the named claim,
+// and reports whether the value contains any templates.
+func parseClaimTemplate(name string, v interface{}) (interface{}, bool, error) {
+	switch v := v.(type) {
+	case string:
+		if !strings.Contains(v, "{{") {
+			return v, false, nil
+		}
+		t, err := template.New(name).Funcs(claimTemplateFuncs).Parse(v)
+		if err != nil {
+			return nil, false, fmt.Errorf("unable to parse template for claim %v: %w", name, err)
+		}
+		return t, true, nil
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		found := false
+		for k, e := range v {
+			t, ok, err := parseClaimTemplate(name+"."+k, e)
+			if err != nil {
+				return nil, false, err
+			}
+			m[k] = t
+			found = found || ok
+		}
+		return m, found, nil
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		found := false
+		for i, e := range v {
+			t, ok, err := parseClaimTemplate(fmt.Sprintf("%v[%v]", name, i), e)
+			if err != nil {
+				return nil, false, err
+			}
+			a[i] = t
+			found = found || ok
+		}
+		return a, found, nil
+	}
+
+	return v, false, nil
+}
+
+// usesRequestHeaders reports whether a claim value parsed by
+// parseClaimTemplate contains a template that calls the header function.
+// Templates that do not use request headers resolve to the same value for
+// every request.
+func usesRequestHeaders(v interface{}) bool {
+	switch v := v.(type) {
+	case *template.Template:
+		return v.Tree != nil && usesHeaderFunc(v.Tree.Root)
+	case map[string]interface{}:
+		for _, e := range v {
+			if usesRequestHeaders(e) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			if usesRequestHeaders(e) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// usesHeaderFunc reports whether the template parse tree rooted at node
+// calls the header function.
+func usesHeaderFunc(node parse.Node) bool {
+	switch n := node.(type) {
+	case *parse.IdentifierNode:
+		return n.Ident == "header"
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Nodes {
+			if usesHeaderFunc(c) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return usesHeaderFunc(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Cmds {
+			if usesHeaderFunc(c) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			if usesHeaderFunc(a) {
+				return true
+			}
+		}
+	case *parse.ChainNode:
+		return usesHeaderFunc(n.Node)
+	case *parse.IfNode:
+		return usesHeaderFunc(n.Pipe) || usesHeaderFunc(n.List) || usesHeaderFunc(n.ElseList)
+	case *parse.RangeNode:
+		return usesHeaderFunc(n.Pipe) || usesHeaderFunc(n.List) || usesHeaderFunc(n.ElseList)
+	case *parse.WithNode:
+		return usesHeaderFunc(n.Pipe) || usesHeaderFunc(n.List) || usesHeaderFunc(n.ElseList)
+	case *parse.TemplateNode:
+		return usesHeaderFunc(n.Pipe)
+	}
+
+	return false
+}
+
+// executeClaimTemplates resolves templated claims for the incoming request.
+// The request may be nil, in which case headers are empty. A template that
+// resolves to an empty string is an error, and nil is returned if there are
+// no templated claims.
+func executeClaimTemplates(templates map[string]interface{}, req *http.Request) (map[string]interface{}, error) {
+	if len(templates) == 0 {
+		return nil, nil
+	}
+
+	funcs := template.FuncMap{
+		"header": func(name string) string {
+			if req == nil {
+				return ""
+			}
+			return req.Header.Get(name)
+		},
+	}
+
+	claims := make(map[string]interface{}, len(templates))
+	for k, v := range templates {
+		claim, err := executeClaimTemplate(v, funcs)
+		if err != nil {
+			return nil, err
+		}
+		claims[k] = claim
+	}
+
+	return claims, nil
+}
+
+// executeClaimTemplate returns a copy of a claim value parsed by
+// parseClaimTemplate, with each template replaced by its resolved value.
+func executeClaimTemplate(v interface{}, funcs template.FuncMap) (interface{}, error) {
+	switch v := v.(type) {
+	case *template.Template:
+		t, err := v.Clone()
+		if err != nil {
+			return nil, fmt.Errorf("unable to clone template for claim %v: %w", v.Name(), err)
+		}
+		b := new(strings.Builder)
+		err = t.Funcs(funcs).Execute(b, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve claim %v: %w", v.Name(), err)
+		}
+		if b.Len() == 0 {
+			return nil, fmt.Errorf("claim %v resolved to an empty value", v.Name())
+		}
+		return b.String(), nil
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			claim, err := executeClaimTemplate(e, funcs)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = claim
+		}
+		return m, nil
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			claim, err := executeClaimTemplate(e, funcs)
+			if err != nil {
+				return nil, err
+			}
+			a[i] = claim
+		}
+		return a, nil
+	}
+
+	return v, nil
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimTemplates(t *testing.T) {
+	t.Setenv("OIDC_PROXY_TEST_REGION", "us-east1")
+	hostname, err := os.Hostname()
+	assert.NoError(t, err)
+
+	templates, err := parseClaimTemplates(
+		map[string]interface{}{
+			"tenant":       `{{ header "X-Tenant" }}`,
+			"on_behalf_of": `{{ header "X-User" | printf "user:%s" }}`,
+			"region":       `{{ env "OIDC_PROXY_TEST_REGION" }}`,
+			"host":         `{{ hostname }}`,
+			"static":       "not a template",
+			"count":        float64(1),
+		},
+	)
+	assert.NoError(t, err)
+	assert.Len(t, templates, 4)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Tenant", "acme")
+	req.Header.Set("X-User", "alice")
+	claims, err := executeClaimTemplates(templates, req)
+	assert.NoError(t, err)
+	assert.Equal(
+		t, map[string]interface{}{
+			"tenant":       "acme",
+			"on_behalf_of": "user:alice",
+			"region":       "us-east1",
+			"host":         hostname,
+		}, claims,
+	)
+
+	// Headers are empty without a request, and empty values are an error.
+	_, err = executeClaimTemplates(templates, nil)
+	assert.ErrorContains(t, err, "resolved to an empty value")
+
+	claims, err = executeClaimTemplates(nil, req)
+	assert.NoError(t, err)
+	assert.Nil(t, claims)
+
+	_, err = parseClaimTemplates(map[string]interface{}{"tenant": `{{ header "X-Tenant" `})
+	assert.ErrorContains(t, err, "unable to parse template for claim tenant")
+}
+
+func TestClaimTemplates_Nested(t *testing.T) {
+	templates, err := parseClaimTemplates(
+		map[string]interface{}{
+			"context": map[string]interface{}{
+				"tenant": `{{ header "X-Tenant" }}`,
+				"roles":  []interface{}{"reader", `{{ header "X-Role" }}`},
+				"level":  float64(1),
+			},
+			"static": map[string]interface{}{"tenant": "not a template"},
+		},
+	)
+	assert.NoError(t, err)
+	assert.Len(t, templates, 1)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Tenant", "acme")
+	req.Header.Set("X-Role", "writer")
+	claims, err := executeClaimTemplates(templates, req)
+	assert.NoError(t, err)
+	assert.Equal(
+		t, map[string]interface{}{
+			"context": map[string]interface{}{
+				"tenant": "acme",
+				"roles":  []interface{}{"reader", "writer"},
+				"level":  float64(1),
+			},
+		}, claims,
+	)
+
+	req.Header.Del("X-Role")
+	_, err = executeClaimTemplates(templates, req)
+	assert.ErrorContains(t, err, "claim context.roles[1] resolved to an empty value")
+
+	_, err = parseClaimTemplates(
+		map[string]interface{}{"context": []interface{}{map[string]interface{}{"tenant": "{{ header "}}},
+	)
+	assert.ErrorContains(t, err, "unable to parse template for claim context[0].tenant")
+}
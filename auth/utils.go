@@ -13,6 +13,40 @@ import (
 )
 
 func ConvertClaimString(claimString string) (*jwt.MapClaims, error) {
+	claimMap, err := decodeClaimString(claimString)
+	if err != nil || claimMap == nil {
+		return nil, err
+	}
+
+	return ConvertClaims(claimMap)
+}
+
+func ConvertValidatableClaimString(claimString string) (*ValidatableMapClaims, error) {
+	claimMap, err := decodeClaimString(claimString)
+	if err != nil {
+		return nil, fmt.Errorf("error converting claim stream: %w", err)
+	}
+
+	if claimMap == nil {
+		return &ValidatableMapClaims{}, nil
+	}
+
+	claims := jwt.MapClaims{}
+	for k, v := range claimMap {
+		switch i := v.(type) {
+		case float64, bool, nil, string:
+			claims[k] = i
+		default:
+			return nil, fmt.Errorf("error converting claim stream: unsupported type for claim key: %v", k)
+		}
+	}
+
+	return convertClaimsToValidatableClaims(claims)
+}
+
+// decodeClaimString decodes a JSON or YAML claim map. An empty string decodes
+// to a nil map.
+func decodeClaimString(claimString string) (map[string]interface{}, error) {
 	var claimMap map[string]interface{}
 	if claimString == "" {
 		return nil, nil
@@ -22,51 +56,65 @@ func ConvertClaimString(claimString string) (*jwt.MapClaims, error) {
 	err := json.Unmarshal([]byte(claimString), &claimMap)
 	if err == nil {
 		log.Println("detected JSON claim map")
-		return ConvertClaims(claimMap)
+		return claimMap, nil
 	}
 
 	err = yaml.Unmarshal([]byte(claimString), &claimMap)
 	if err == nil {
 		log.Println("detected YAML claim map")
-		return ConvertClaims(claimMap)
+		return claimMap, nil
 	}
 
 	return nil, errors.New("unable to decode claim map")
 }
 
-func ConvertValidatableClaimString(claimString string) (*ValidatableMapClaims, error) {
-	claimMap, err := ConvertClaimString(claimString)
-	if err != nil {
-		return nil, fmt.Errorf("error converting claim stream: %w", err)
-	}
-
-	if claimMap == nil {
-		return &ValidatableMapClaims{}, nil
-	}
-
-	return convertClaimsToValidatableClaims(*claimMap)
-}
-
 func ConvertClaims(claimMap map[string]interface{}) (*jwt.MapClaims, error) {
 	claims := jwt.MapClaims{}
 	for k, v := range claimMap {
-		switch i := v.(type) {
-		case float64:
-			claims[k] = i
-		case bool:
-			claims[k] = i
-		case nil:
-			claims[k] = i
-		case string:
-			claims[k] = i
-		default:
+		c, err := convertClaimValue(v)
+		if err != nil {
 			return nil, fmt.Errorf("unsupported type for claim key: %v\n", k)
 		}
+		claims[k] = c
 	}
 
 	return &claims, nil
 }
 
+// convertClaimValue converts a decoded JSON or YAML claim value to the type
+// used for the claim in a parsed JWT. Arrays and objects are converted
+// recursively, and integers decoded from YAML are converted to float64.
+func convertClaimValue(v interface{}) (interface{}, error) {
+	switch i := v.(type) {
+	case float64, bool, nil, string:
+		return i, nil
+	case int:
+		return float64(i), nil
+	case []interface{}:
+		values := make([]interface{}, len(i))
+		for n, e := range i {
+			c, err := convertClaimValue(e)
+			if err != nil {
+				return nil, err
+			}
+			values[n] = c
+		}
+		return values, nil
+	case map[string]interface{}:
+		values := make(map[string]interface{}, len(i))
+		for k, e := range i {
+			c, err := convertClaimValue(e)
+			if err != nil {
+				return nil, err
+			}
+			values[k] = c
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unsupported claim type: %T", v)
+	}
+}
+
 func convertClaimsToValidatableClaims(claimMap jwt.MapClaims) (*ValidatableMapClaims, error) {
 	claims := ValidatableMapClaims{}
 	for k, v := range claimMap {
@@ -38,3 +38,24 @@ func TestConvertValidatableClaimString(t *testing.T) {
 		assert.True(t, false)
 	}
 }
+
+func TestConvertClaimString_Nested(t *testing.T) {
+	res, err := ConvertClaimString(`{"groups": ["a", "b"], "address": {"country": "US", "codes": [1, 2]}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"a", "b"}, (*res)["groups"])
+	assert.Equal(
+		t, map[string]interface{}{"country": "US", "codes": []interface{}{float64(1), float64(2)}}, (*res)["address"],
+	)
+
+	res, err = ConvertClaimString("groups:\n  - a\n  - b\nlevel: 3\naddress:\n  country: US\n")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"a", "b"}, (*res)["groups"])
+	assert.Equal(t, float64(3), (*res)["level"])
+	assert.Equal(t, map[string]interface{}{"country": "US"}, (*res)["address"])
+
+	// Nested claims are only supported for signing, not for validation.
+	_, err = ConvertValidatableClaimString(`{"groups": ["a", "b"]}`)
+	assert.ErrorContains(t, err, "unsupported type for claim key: groups")
+	_, err = ConvertValidatableClaimString("level: 3\n")
+	assert.ErrorContains(t, err, "unsupported type for claim key: level")
+}
@@ -0,0 +1,333 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VaultTokenRetriever is an implementation of JwtTokenRetriever for OIDC
+// identity tokens issued by the HashiCorp Vault identity secrets engine. The
+// retriever authenticates to Vault using a token file, AppRole or Kubernetes
+// auth, and renews its Vault token in the background until it is
+// reconfigured.
+type VaultTokenRetriever struct {
+	address   string
+	role      string
+	namespace string
+	client    *http.Client
+	login     func() (*vaultAuth, error)
+	done      chan struct{}
+
+	mu    sync.RWMutex
+	token string
+}
+
+// A VaultTokenConfig contains configuration data used to initialize and
+// validate a VaultTokenRetriever object.
+type VaultTokenConfig struct {
+	Address             string `long:"address" env:"ADDRESS" description:"Vault server address (defaults to VAULT_ADDR)"`
+	Namespace           string `long:"namespace" env:"NAMESPACE" description:"Vault namespace"`
+	Role                string `long:"role" env:"ROLE" description:"Vault identity OIDC role used to mint tokens"`
+	AuthMethod          string `long:"auth-method" env:"AUTH_METHOD" description:"Vault authentication method" choice:"token" choice:"approle" choice:"kubernetes" default:"token"`
+	AuthMount           string `long:"auth-mount" env:"AUTH_MOUNT" description:"Mount path of the Vault authentication method (defaults to the method name)"`
+	TokenFile           string `long:"token-file" env:"TOKEN_FILE" description:"Path to a Vault token for token authentication (defaults to VAULT_TOKEN)"`
+	RoleId              string `long:"role-id" env:"ROLE_ID" description:"AppRole role ID"`
+	SecretIdFile        string `long:"secret-id-file" env:"SECRET_ID_FILE" description:"Path to the AppRole secret ID"`
+	KubernetesRole      string `long:"kubernetes-role" env:"KUBERNETES_ROLE" description:"Vault role for Kubernetes authentication"`
+	KubernetesTokenPath string `long:"kubernetes-token-path" env:"KUBERNETES_TOKEN_PATH" description:"Path to the service account token for Kubernetes authentication" default:"/var/run/secrets/kubernetes.io/serviceaccount/token"`
+	Audience            string `no-flag:"true"`
+}
+
+// vaultAuth is the auth block of a Vault login or token renewal response.
+type vaultAuth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+// vaultResponse contains the fields of Vault API responses used by the
+// VaultTokenRetriever.
+type vaultResponse struct {
+	Auth *vaultAuth `json:"auth"`
+	Data struct {
+		Token     string `json:"token"`
+		Ttl       int    `json:"ttl"`
+		Renewable bool   `json:"renewable"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// GetToken mints a new identity token using the configured Vault role. The
+// audience of Vault identity tokens is the client ID of the role, so an error
+// is returned if it does not match the requested audience.
+func (r *VaultTokenRetriever) GetToken(aud string) (string, error) {
+	resp, err := r.request("GET", "identity/oidc/token/"+url.PathEscape(r.role), r.vaultToken(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch token: %w", err)
+	}
+	if resp.Data.Token == "" {
+		return "", errors.New("Vault response did not contain a token")
+	}
+
+	err = checkTokenAudience(resp.Data.Token, aud)
+	if err != nil {
+		return "", fmt.Errorf("Vault role %v is not configured for the audience: %w", r.role, err)
+	}
+
+	return resp.Data.Token, nil
+}
+
+// Configure will take a valid VaultTokenConfig and use it to configure the
+// token retriever. After authenticating, a token is minted to confirm that the
+// role issues tokens for the configured audience.
+func (r *VaultTokenRetriever) Configure(config interface{}) error {
+	c, ok := config.(*VaultTokenConfig)
+	if !ok {
+		log.Fatalln("internal error: incorrect token config")
+	}
+	if c.Role == "" {
+		return errors.New("Vault role must not be empty")
+	}
+
+	// Stop renewing the Vault token from a previous configuration.
+	r.stopRenewal()
+
+	r.address = c.Address
+	if r.address == "" {
+		r.address = os.Getenv("VAULT_ADDR")
+	}
+	if r.address == "" {
+		return unavailable(errors.New("Vault address or VAULT_ADDR must be specified"))
+	}
+	r.address = strings.TrimSuffix(r.address, "/")
+	r.role = c.Role
+	r.namespace = c.Namespace
+	r.client = &http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	mount := c.AuthMount
+	if mount == "" {
+		mount = c.AuthMethod
+	}
+
+	switch c.AuthMethod {
+	case "token":
+		r.login = func() (*vaultAuth, error) {
+			return r.tokenLogin(c.TokenFile)
+		}
+	case "approle":
+		if c.RoleId == "" || c.SecretIdFile == "" {
+			return errors.New("AppRole role ID and secret ID file must be specified")
+		}
+		r.login = func() (*vaultAuth, error) {
+			secretId, err := os.ReadFile(c.SecretIdFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read AppRole secret ID: %w", err)
+			}
+			return r.authLogin(
+				mount, map[string]string{
+					"role_id":   c.RoleId,
+					"secret_id": strings.TrimSpace(string(secretId)),
+				},
+			)
+		}
+	case "kubernetes":
+		if c.KubernetesRole == "" {
+			return errors.New("Vault Kubernetes role must be specified")
+		}
+		r.login = func() (*vaultAuth, error) {
+			jwt, err := os.ReadFile(c.KubernetesTokenPath)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read service account token: %w", err)
+			}
+			return r.authLogin(
+				mount, map[string]string{
+					"role": c.KubernetesRole,
+					"jwt":  strings.TrimSpace(string(jwt)),
+				},
+			)
+		}
+	default:
+		return fmt.Errorf("unknown Vault auth method: %v", c.AuthMethod)
+	}
+
+	auth, err := r.login()
+	if err != nil {
+		return fmt.Errorf("unable to authenticate to Vault: %w", err)
+	}
+	r.setVaultToken(auth.ClientToken)
+
+	if c.Audience != "" {
+		_, err = r.GetToken(c.Audience)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.done = make(chan struct{})
+	go r.renew(auth, r.done)
+
+	return nil
+}
+
+// stopRenewal stops renewing the Vault token in the background. It is safe to
+// call stopRenewal when the token is not being renewed.
+func (r *VaultTokenRetriever) stopRenewal() {
+	if r.done != nil {
+		close(r.done)
+		r.done = nil
+	}
+}
+
+// tokenLogin reads a Vault token from a file or the VAULT_TOKEN environment
+// variable, and looks up its lease.
+func (r *VaultTokenRetriever) tokenLogin(tokenFile string) (*vaultAuth, error) {
+	token := os.Getenv("VAULT_TOKEN")
+	if tokenFile != "" {
+		b, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read Vault token: %w", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token == "" {
+		return nil, errors.New("Vault token file or VAULT_TOKEN must be specified")
+	}
+
+	resp, err := r.request("GET", "auth/token/lookup-self", token, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up Vault token: %w", err)
+	}
+
+	return &vaultAuth{
+		ClientToken:   token,
+		LeaseDuration: resp.Data.Ttl,
+		Renewable:     resp.Data.Renewable,
+	}, nil
+}
+
+// authLogin logs in to a Vault auth method mount.
+func (r *VaultTokenRetriever) authLogin(mount string, body map[string]string) (*vaultAuth, error) {
+	resp, err := r.request("POST", fmt.Sprintf("auth/%v/login", strings.Trim(mount, "/")), "", body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return nil, errors.New("Vault login response did not contain a token")
+	}
+
+	return resp.Auth, nil
+}
+
+// renew keeps the Vault token alive by renewing it at half of its lease
+// duration, until done is closed. If the token can not be renewed, the
+// retriever logs in again.
+func (r *VaultTokenRetriever) renew(auth *vaultAuth, done chan struct{}) {
+	for {
+		if auth.LeaseDuration <= 0 {
+			// Tokens without a TTL, such as root tokens, never expire.
+			return
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Duration(auth.LeaseDuration) * time.Second / 2):
+		}
+
+		var err error
+		if auth.Renewable {
+			var resp *vaultResponse
+			resp, err = r.request("POST", "auth/token/renew-self", r.vaultToken(), nil)
+			if err == nil && resp.Auth != nil && resp.Auth.LeaseDuration > 0 {
+				auth = resp.Auth
+				r.setVaultToken(auth.ClientToken)
+				continue
+			}
+			if err != nil {
+				log.Printf("unable to renew Vault token: %v\n", err)
+			}
+		}
+
+		newAuth, err := r.login()
+		if err != nil {
+			log.Printf("unable to authenticate to Vault: %v\n", err)
+			auth = &vaultAuth{LeaseDuration: 10, Renewable: false}
+			continue
+		}
+		auth = newAuth
+		r.setVaultToken(auth.ClientToken)
+	}
+}
+
+// request sends a request to the Vault API and decodes the response.
+func (r *VaultTokenRetriever) request(method string, path string, token string, body interface{}) (*vaultResponse, error) {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding Vault request: %w", err)
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("%v/v1/%v", r.address, path), reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("error creating Vault request: %w", err)
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if r.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", r.namespace)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	vaultResp := vaultResponse{}
+	err = json.Unmarshal(respBody, &vaultResp)
+	if resp.StatusCode != 200 {
+		if err == nil && len(vaultResp.Errors) > 0 {
+			return nil, fmt.Errorf("unsuccessful status code from Vault: %v, %v", resp.StatusCode, strings.Join(vaultResp.Errors, ", "))
+		}
+		return nil, fmt.Errorf("unsuccessful status code from Vault: %v, %v", resp.StatusCode, string(respBody))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode Vault response: %w", err)
+	}
+
+	return &vaultResp, nil
+}
+
+// vaultToken returns the current Vault token.
+func (r *VaultTokenRetriever) vaultToken() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.token
+}
+
+// setVaultToken replaces the current Vault token.
+func (r *VaultTokenRetriever) setVaultToken(token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.token = token
+}
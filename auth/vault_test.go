@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startFakeVault(t *testing.T, renewals *atomic.Int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(rw http.ResponseWriter, r *http.Request) {
+				resp := map[string]interface{}{}
+				switch r.URL.Path {
+				case "/v1/auth/approle/login":
+					body := map[string]string{}
+					assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+					if body["role_id"] != "test-role-id" || body["secret_id"] != "test-secret-id" {
+						rw.WriteHeader(http.StatusBadRequest)
+						_, _ = rw.Write([]byte(`{"errors":["invalid role or secret ID"]}`))
+						return
+					}
+					resp["auth"] = vaultAuth{ClientToken: "test-vault-token", LeaseDuration: 1, Renewable: true}
+				case "/v1/auth/token/renew-self":
+					renewals.Add(1)
+					resp["auth"] = vaultAuth{ClientToken: "test-vault-token", LeaseDuration: 1, Renewable: true}
+				case "/v1/identity/oidc/token/test-role":
+					if r.Header.Get("X-Vault-Token") != "test-vault-token" {
+						rw.WriteHeader(http.StatusForbidden)
+						_, _ = rw.Write([]byte(`{"errors":["permission denied"]}`))
+						return
+					}
+					resp["data"] = map[string]interface{}{"token": newTestToken(t, "test-client-id", "test-entity")}
+				default:
+					rw.WriteHeader(http.StatusNotFound)
+					_, _ = rw.Write([]byte(`{"errors":[]}`))
+					return
+				}
+				_ = json.NewEncoder(rw).Encode(resp)
+			},
+		),
+	)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestVaultTokenRetriever(t *testing.T) {
+	renewals := &atomic.Int32{}
+	server := startFakeVault(t, renewals)
+
+	secretIdFile := filepath.Join(t.TempDir(), "secret-id")
+	err := os.WriteFile(secretIdFile, []byte("test-secret-id\n"), 0600)
+	assert.NoError(t, err)
+
+	config := &VaultTokenConfig{
+		Address:      server.URL,
+		Role:         "test-role",
+		AuthMethod:   "approle",
+		RoleId:       "test-role-id",
+		SecretIdFile: secretIdFile,
+		Audience:     "test-client-id",
+	}
+	retriever := new(VaultTokenRetriever)
+	err = retriever.Configure(config)
+	assert.NoError(t, err)
+
+	token, err := retriever.GetToken("test-client-id")
+	assert.NoError(t, err)
+	assert.NoError(t, checkTokenAudience(token, "test-client-id"))
+
+	_, err = retriever.GetToken("other-svc")
+	assert.Error(t, err)
+
+	assert.Eventually(
+		t, func() bool {
+			return renewals.Load() > 0
+		}, 3*time.Second, 50*time.Millisecond,
+	)
+
+	// Renewal stops when the retriever is reconfigured.
+	retriever.stopRenewal()
+	time.Sleep(100 * time.Millisecond)
+	stopped := renewals.Load()
+	time.Sleep(time.Second)
+	assert.Equal(t, stopped, renewals.Load())
+
+	config.Audience = "other-svc"
+	err = new(VaultTokenRetriever).Configure(config)
+	assert.ErrorContains(t, err, "not configured for the audience")
+
+	config.Audience = "test-client-id"
+	config.RoleId = "wrong-role-id"
+	err = new(VaultTokenRetriever).Configure(config)
+	assert.ErrorContains(t, err, "invalid role or secret ID")
+
+	// Without an address, the auth type is unavailable.
+	t.Setenv("VAULT_ADDR", "")
+	config.Address = ""
+	err = new(VaultTokenRetriever).Configure(config)
+	assert.ErrorIs(t, err, ErrUnavailable)
+}
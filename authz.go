@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"reflect"
 	"strings"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -15,11 +18,17 @@ import (
 )
 
 // modifyRequestAuthz will modify an in-flight request in egress mode to
-// insert the authorization header and JWT.
-func modifyRequestAuthz(rw http.ResponseWriter, req *http.Request, manager auth.JwtManager, aud string) bool {
-	token, err := manager.Token(aud)
+// insert the authorization header and JWT. If a token can not be obtained,
+// the response status is 400 when the request claims can not be resolved,
+// and 503 otherwise.
+func modifyRequestAuthz(rw http.ResponseWriter, req *http.Request, manager *auth.JwtManager, aud string) bool {
+	token, err := manager.RequestToken(aud, req)
 	if err != nil {
-		rw.WriteHeader(http.StatusBadRequest)
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, auth.ErrRequestClaims) {
+			status = http.StatusBadRequest
+		}
+		rw.WriteHeader(status)
 		_, _ = rw.Write([]byte(fmt.Sprintf("error obtaining token: %v", err)))
 		return false
 	}
@@ -86,20 +95,61 @@ func convertAudienceString(audString string) ([]string, error) {
 	return []string{audString}, nil
 }
 
-// detectValidatingKey attempts to detect the key-type for JWT validation.
-func detectValidatingKey(b []byte) interface{} {
+// loadValidatingKey returns a function that detects the validating key in the
+// contents of a key file and sets it on the key manager. Once a key has been
+// loaded, a key of a different type is rejected, so that a partially written
+// public key is not used as a symmetric key.
+func loadValidatingKey(m *auth.ManualKeyManager) func([]byte) error {
+	var loaded interface{}
+	return func(b []byte) error {
+		if len(b) == 0 {
+			return errors.New("validating key must not be empty")
+		}
+		key, err := detectValidatingKey(b)
+		if err != nil {
+			return err
+		}
+		if loaded != nil && reflect.TypeOf(key) != reflect.TypeOf(loaded) {
+			return fmt.Errorf("validating key type %T does not match the loaded key type %T", key, loaded)
+		}
+		loaded = key
+		m.SetKey(key)
+		return nil
+	}
+}
+
+// detectValidatingKey attempts to detect the key-type for JWT validation. A
+// PEM block that is not a supported public key is an error, rather than being
+// used as a symmetric key.
+func detectValidatingKey(b []byte) (interface{}, error) {
 	privKey, err := jwt.ParseRSAPublicKeyFromPEM(b)
 	if err == nil {
 		log.Println("detected RSA public key")
-		return privKey
+		return privKey, nil
+	}
+
+	ecKey, err := jwt.ParseECPublicKeyFromPEM(b)
+	if err == nil {
+		log.Println("detected EC public key")
+		return ecKey, nil
+	}
+
+	edKey, err := jwt.ParseEdPublicKeyFromPEM(b)
+	if err == nil {
+		log.Println("detected Ed25519 public key")
+		return edKey, nil
+	}
+
+	if bytes.Contains(b, []byte("-----BEGIN")) {
+		return nil, errors.New("unable to parse PEM validating key, only RSA, EC and Ed25519 public keys are supported")
 	}
 
 	decodedKey, err := base64.StdEncoding.DecodeString(string(b))
 	if err == nil {
 		log.Println("detected base64-encoded symmetric key")
-		return decodedKey
+		return decodedKey, nil
 	}
 
 	log.Println("detected raw symmetric key")
-	return b
+	return b, nil
 }
@@ -1,13 +1,22 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/mbrancato/oidc-proxy/auth"
@@ -45,3 +54,109 @@ func TestModifyValidateRequest(t *testing.T) {
 		println(string(b))
 	}
 }
+
+func TestModifyRequestAuthz_Errors(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://foo", nil)
+	rw := httptest.NewRecorder()
+	assert.False(t, modifyRequestAuthz(rw, req, auth.NewJwtManager(&failingTokenRetriever{}), "foo"))
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+
+	retriever := new(auth.ManualTokenRetriever)
+	err := retriever.Configure(
+		&auth.ManualTokenConfig{
+			Key:           "testing",
+			SigningMethod: "hs256",
+			Issuer:        "https://foo",
+			Subject:       "foo@test",
+			Claims:        `{"tenant": "{{ header \"X-Tenant\" }}"}`,
+		},
+	)
+	assert.NoError(t, err)
+	rw = httptest.NewRecorder()
+	assert.False(t, modifyRequestAuthz(rw, req, auth.NewJwtManager(retriever), "foo"))
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+}
+
+func TestDetectValidatingKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	publicPem := func(key interface{}) []byte {
+		b, err := x509.MarshalPKIXPublicKey(key)
+		assert.NoError(t, err)
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b})
+	}
+
+	detect := func(b []byte) interface{} {
+		key, err := detectValidatingKey(b)
+		assert.NoError(t, err)
+		return key
+	}
+
+	assert.IsType(t, &rsa.PublicKey{}, detect(publicPem(&rsaKey.PublicKey)))
+	assert.IsType(t, &ecdsa.PublicKey{}, detect(publicPem(&ecKey.PublicKey)))
+	assert.IsType(t, ed25519.PublicKey{}, detect(publicPem(edKey)))
+	assert.Equal(t, []byte("testing"), detect([]byte("dGVzdGluZw==")))
+	assert.Equal(t, []byte("testing!"), detect([]byte("testing!")))
+
+	// A PEM block that does not parse is not used as a symmetric key.
+	rsaPem := publicPem(&rsaKey.PublicKey)
+	_, err = detectValidatingKey(rsaPem[:len(rsaPem)/2])
+	assert.ErrorContains(t, err, "unable to parse PEM validating key")
+	_, err = detectValidatingKey(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: []byte("x")}))
+	assert.Error(t, err)
+}
+
+func TestLoadValidatingKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	b, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	assert.NoError(t, err)
+	publicPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b})
+
+	signed, err := jwt.NewWithClaims(
+		jwt.SigningMethodRS256, jwt.MapClaims{
+			"aud": "foo",
+			"iss": "https://foo",
+			"sub": "foo",
+			"iat": time.Now().Unix(),
+			"exp": time.Now().Add(time.Hour).Unix(),
+		},
+	).SignedString(rsaKey)
+	assert.NoError(t, err)
+
+	manager := auth.NewManualKeyManager(nil, &auth.ValidatableMapClaims{"aud": "foo"})
+	load := loadValidatingKey(manager)
+	assert.NoError(t, load(publicPem))
+
+	// A partially written key or a key of a different type is rejected, and
+	// the previous key is kept.
+	assert.ErrorContains(t, load(publicPem[:len(publicPem)/2]), "unable to parse PEM validating key")
+	assert.ErrorContains(t, load([]byte("secret")), "does not match the loaded key type")
+	assert.Error(t, load(nil))
+	valid, err := manager.Validate(signed)
+	assert.True(t, valid)
+	assert.NoError(t, err)
+
+	assert.NoError(t, load(publicPem))
+
+	// A token signed with HS256 using the public key as the secret is
+	// rejected.
+	forged, err := jwt.NewWithClaims(
+		jwt.SigningMethodHS256, jwt.MapClaims{
+			"aud": "foo",
+			"iss": "https://foo",
+			"sub": "foo",
+			"iat": time.Now().Unix(),
+			"exp": time.Now().Add(time.Hour).Unix(),
+		},
+	).SignedString(publicPem)
+	assert.NoError(t, err)
+	valid, err = manager.Validate(forged)
+	assert.False(t, valid)
+	assert.ErrorContains(t, err, "signing method HS256 is not valid for the key")
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"errors"
+	"time"
 
 	"github.com/mbrancato/oidc-proxy/auth"
 )
@@ -9,19 +10,22 @@ import (
 // ProxyConfig is the base configuration for the oidc-proxy. It it used to
 // generate all command line flags and configuration environment variables.
 type ProxyConfig struct {
-	TargetUrl string             `long:"target-url" env:"OIDC_PROXY_TARGET_URL" description:"Target URL for incoming requests" required:"true"`
-	Ingress   ProxyIngressConfig `group:"ingress" namespace:"ingress" env-namespace:"OIDC_PROXY_INGRESS"`
-	Egress    ProxyEgressConfig  `group:"egress" namespace:"egress" env-namespace:"OIDC_PROXY_EGRESS"`
-	Audience  string             `long:"audience" env:"OIDC_PROXY_AUDIENCE" description:"Audience claim for token" required:"true"`
-	Port      int                `long:"port" env:"OIDC_PROXY_PORT" description:"Port to listen for requests" default:"8080"`
-	Address   string             `long:"address" env:"OIDC_PROXY_ADDRESS" description:"Address to listen for requests" default:"127.0.0.1"`
-	TLS       ProxyTLSConfig     `group:"tls" namespace:"tls" env-namespace:"OIDC_PROXY_TLS"`
+	TargetUrl    string             `long:"target-url" env:"OIDC_PROXY_TARGET_URL" description:"Target URL for incoming requests" required:"true"`
+	Ingress      ProxyIngressConfig `group:"ingress" namespace:"ingress" env-namespace:"OIDC_PROXY_INGRESS"`
+	Egress       ProxyEgressConfig  `group:"egress" namespace:"egress" env-namespace:"OIDC_PROXY_EGRESS"`
+	Audience     string             `long:"audience" env:"OIDC_PROXY_AUDIENCE" description:"Audience claim for token" required:"true"`
+	Port         int                `long:"port" env:"OIDC_PROXY_PORT" description:"Port to listen for requests" default:"8080"`
+	Address      string             `long:"address" env:"OIDC_PROXY_ADDRESS" description:"Address to listen for requests" default:"127.0.0.1"`
+	AdminPort    int                `long:"admin-port" env:"OIDC_PROXY_ADMIN_PORT" description:"Port to listen for health check and key set requests (disabled if not set)"`
+	AdminAddress string             `long:"admin-address" env:"OIDC_PROXY_ADMIN_ADDRESS" description:"Address to listen for health check and key set requests (defaults to the listen address)"`
+	TLS          ProxyTLSConfig     `group:"tls" namespace:"tls" env-namespace:"OIDC_PROXY_TLS"`
 }
 
 // ProxyTLSConfig contains configuration information about listening for
 // requests using TLS and for making outbound requests over TLS.
 type ProxyTLSConfig struct {
 	Listen        bool   `long:"listen-enabled" env:"LISTEN_ENABLED" description:"Listen for requests using TLS"`
+	AdminListen   bool   `long:"admin-listen-enabled" env:"ADMIN_LISTEN_ENABLED" description:"Listen for admin requests using TLS"`
 	Cert          string `long:"cert" env:"CERT" description:"Path to TLS public certificate (PEM format)"`
 	Key           string `long:"key" env:"KEY" description:"Path to TLS private key (PEM format)"`
 	AllowInsecure bool   `long:"allow-insecure-target" env:"ALLOW_INSECURE_TARGET" description:"Do not verify TLS for the target"`
@@ -29,25 +33,68 @@ type ProxyTLSConfig struct {
 
 // ProxyEgressConfig contains configuration data for egress mode.
 type ProxyEgressConfig struct {
-	Enabled bool                  `long:"enabled" env:"ENABLED" description:"Enable egress mode"`
-	Auth    ProxyEgressAuthConfig `group:"egress.auth" namespace:"auth" env-namespace:"AUTH"`
+	Enabled bool                     `long:"enabled" env:"ENABLED" description:"Enable egress mode"`
+	Auth    ProxyEgressAuthConfig    `group:"egress.auth" namespace:"auth" env-namespace:"AUTH"`
+	Renewal ProxyEgressRenewalConfig `group:"egress.renewal" namespace:"renewal" env-namespace:"RENEWAL"`
+	Cache   ProxyEgressCacheConfig   `group:"egress.cache" namespace:"cache" env-namespace:"CACHE"`
+}
+
+// ProxyEgressCacheConfig contains configuration information for persisting
+// tokens to an encrypted file in egress mode.
+type ProxyEgressCacheConfig struct {
+	Path string `long:"path" env:"PATH" description:"Path of an encrypted file used to persist tokens across restarts"`
+	Key  string `long:"key" env:"KEY" description:"Key used to encrypt the token cache file"`
+}
+
+// ProxyEgressRenewalConfig contains configuration information for when tokens
+// are renewed in egress mode.
+type ProxyEgressRenewalConfig struct {
+	Fraction float64       `long:"fraction" env:"FRACTION" description:"Fraction of the token lifetime after which tokens are renewed" default:"0.8"`
+	Skew     time.Duration `long:"skew" env:"SKEW" description:"Renew tokens at least this long before they expire" default:"1m"`
 }
 
 // ProxyEgressAuthConfig contains configuration information for the selected auth method.
 type ProxyEgressAuthConfig struct {
-	Type   string                 `long:"type" env:"TYPE" description:"Authentication type for egress mode"`
-	Static auth.StaticTokenConfig `group:"egress.auth.static" namespace:"static" env-namespace:"STATIC"`
-	Manual auth.ManualTokenConfig `group:"egress.auth.manual" namespace:"manual" env-namespace:"MANUAL"`
-	Gcp    auth.GcpTokenConfig    `group:"egress.auth.gcp" namespace:"gcp" env-namespace:"GCP"`
+	Type          string                        `long:"type" env:"TYPE" description:"Authentication type for egress mode, or a comma separated list of fallback types"`
+	Chain         auth.ChainTokenConfig         `group:"egress.auth.chain" namespace:"chain" env-namespace:"CHAIN"`
+	Static        auth.StaticTokenConfig        `group:"egress.auth.static" namespace:"static" env-namespace:"STATIC"`
+	Manual        auth.ManualTokenConfig        `group:"egress.auth.manual" namespace:"manual" env-namespace:"MANUAL"`
+	Gcp           auth.GcpTokenConfig           `group:"egress.auth.gcp" namespace:"gcp" env-namespace:"GCP"`
+	Kubernetes    auth.KubernetesTokenConfig    `group:"egress.auth.kubernetes" namespace:"kubernetes" env-namespace:"KUBERNETES"`
+	KubernetesApi auth.KubernetesApiTokenConfig `group:"egress.auth.kubernetes-api" namespace:"kubernetes-api" env-namespace:"KUBERNETES_API"`
+	Spiffe        auth.SpiffeTokenConfig        `group:"egress.auth.spiffe" namespace:"spiffe" env-namespace:"SPIFFE"`
+	Azure         auth.AzureTokenConfig         `group:"egress.auth.azure" namespace:"azure" env-namespace:"AZURE"`
+	Aws           auth.AwsTokenConfig           `group:"egress.auth.aws" namespace:"aws" env-namespace:"AWS"`
+	GithubActions auth.GithubActionsTokenConfig `group:"egress.auth.github-actions" namespace:"github-actions" env-namespace:"GITHUB_ACTIONS"`
+	GitlabCi      auth.GitlabCiTokenConfig      `group:"egress.auth.gitlab-ci" namespace:"gitlab-ci" env-namespace:"GITLAB_CI"`
+	Vault         auth.VaultTokenConfig         `group:"egress.auth.vault" namespace:"vault" env-namespace:"VAULT"`
+	Oauth2        auth.Oauth2TokenConfig        `group:"egress.auth.oauth2" namespace:"oauth2" env-namespace:"OAUTH2"`
+	TokenExchange auth.ExchangeTokenConfig      `group:"egress.auth.token-exchange" namespace:"token-exchange" env-namespace:"TOKEN_EXCHANGE"`
+	Exec          auth.ExecTokenConfig          `group:"egress.auth.exec" namespace:"exec" env-namespace:"EXEC"`
 }
 
 // ProxyIngressConfig contains configuration data for ingress mode.
 type ProxyIngressConfig struct {
-	Enabled     bool   `long:"enabled" env:"ENABLED" description:"Enable ingress mode"`
-	JwksUrl     string `long:"jwks-url" env:"JWKS_URL" description:"JSON web key set URL for key validation"`
-	KeyData     string `long:"validating-key" env:"VALIDATING_KEY" description:"Signing key for validation"`
-	StaticToken string `long:"static-token" env:"STATIC_TOKEN" description:"Static identity token for validation"`
-	ValidClaims string `long:"valid-claims" env:"VALID_CLAIMS" description:"Claims for validation (JSON or YAML map)"`
+	Enabled         bool                     `long:"enabled" env:"ENABLED" description:"Enable ingress mode"`
+	JwksUrl         string                   `long:"jwks-url" env:"JWKS_URL" description:"JSON web key set URL for key validation"`
+	Issuer          string                   `long:"issuer" env:"ISSUER" description:"Issuer URL used to discover the JSON web key set, tokens must have this exact issuer"`
+	KeyData         string                   `long:"validating-key" env:"VALIDATING_KEY" description:"Signing key for validation"`
+	KeyFile         string                   `long:"validating-key-file" env:"VALIDATING_KEY_FILE" description:"Path to a file containing the signing key for validation"`
+	Keyring         string                   `long:"validating-keyring" env:"VALIDATING_KEYRING" description:"Path to a keyring file or directory of validating keys selected by key ID"`
+	ReloadInterval  time.Duration            `long:"reload-interval" env:"RELOAD_INTERVAL" description:"Interval for checking validating key, keyring and static token files for changes" default:"30s"`
+	StaticToken     string                   `long:"static-token" env:"STATIC_TOKEN" description:"Static identity token for validation"`
+	StaticTokenFile string                   `long:"static-token-file" env:"STATIC_TOKEN_FILE" description:"Path to a file containing the static identity token for validation"`
+	ValidClaims     string                   `long:"valid-claims" env:"VALID_CLAIMS" description:"Claims for validation (JSON or YAML map)"`
+	Spiffe          ProxyIngressSpiffeConfig `group:"ingress.spiffe" namespace:"spiffe" env-namespace:"SPIFFE"`
+}
+
+// ProxyIngressSpiffeConfig contains configuration data for validating
+// JWT-SVIDs using the SPIFFE Workload API in ingress mode.
+type ProxyIngressSpiffeConfig struct {
+	Enabled     bool   `long:"enabled" env:"ENABLED" description:"Validate JWT-SVIDs using the SPIFFE Workload API"`
+	SocketPath  string `long:"socket-path" env:"SOCKET_PATH" description:"SPIFFE Workload API socket address (defaults to SPIFFE_ENDPOINT_SOCKET)"`
+	SpiffeId    string `long:"id" env:"ID" description:"SPIFFE ID required in the JWT-SVID subject"`
+	TrustDomain string `long:"trust-domain" env:"TRUST_DOMAIN" description:"SPIFFE trust domain the JWT-SVID subject must be a member of"`
 }
 
 // ValidateConfig checks to make sure that the provided flags make sense and are valid.
@@ -64,17 +111,40 @@ func (p *ProxyConfig) ValidateConfig() error {
 		if p.Egress.Auth.Type == "" {
 			return errors.New("egress mode: auth type is required")
 		}
+		if p.Egress.Renewal.Fraction <= 0 || p.Egress.Renewal.Fraction > 1 {
+			return errors.New("egress mode: renewal fraction must be greater than 0 and at most 1")
+		}
+		if p.Egress.Renewal.Skew < 0 {
+			return errors.New("egress mode: renewal skew must not be negative")
+		}
+		if p.Egress.Cache.Path != "" && p.Egress.Cache.Key == "" {
+			return errors.New("egress mode: a key is required for the token cache")
+		}
 
 	} else if p.Ingress.Enabled {
-		if p.Ingress.JwksUrl == "" && p.Ingress.KeyData == "" && p.Ingress.StaticToken == "" {
-			return errors.New("ingress mode: JWKS URL, validating key, or static token is required")
+		if p.Ingress.Issuer == "" && p.Ingress.JwksUrl == "" && p.Ingress.KeyData == "" && p.Ingress.KeyFile == "" &&
+			p.Ingress.Keyring == "" && p.Ingress.StaticToken == "" && p.Ingress.StaticTokenFile == "" &&
+			!p.Ingress.Spiffe.Enabled {
+			return errors.New("ingress mode: issuer, JWKS URL, validating key, validating keyring, static token, or SPIFFE is required")
+		}
+		if p.Ingress.Issuer != "" && p.Ingress.JwksUrl != "" {
+			return errors.New("ingress mode: only one of issuer or JWKS URL may be specified")
+		}
+		if p.Ingress.KeyData != "" && p.Ingress.KeyFile != "" {
+			return errors.New("ingress mode: only one of validating key or validating key file may be specified")
+		}
+		if p.Ingress.StaticToken != "" && p.Ingress.StaticTokenFile != "" {
+			return errors.New("ingress mode: only one of static token or static token file may be specified")
+		}
+		if p.Ingress.Spiffe.SpiffeId != "" && p.Ingress.Spiffe.TrustDomain != "" {
+			return errors.New("ingress mode: only one of SPIFFE ID or trust domain may be specified")
 		}
 
 	} else {
 		return errors.New("no direction specified, choose Ingress or Egress")
 	}
 
-	if p.TLS.Listen && (p.TLS.Cert == "" || p.TLS.Key == "") {
+	if (p.TLS.Listen || p.TLS.AdminListen) && (p.TLS.Cert == "" || p.TLS.Key == "") {
 		return errors.New("when TLS is enabled, a certificate and key path must be specified")
 	}
 
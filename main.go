@@ -2,7 +2,11 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,6 +14,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/jessevdk/go-flags"
@@ -61,25 +66,9 @@ func main() {
 		ExpectContinueTimeout: 1 * time.Second,
 	}
 
+	var adminHandler http.Handler
 	if cfg.Egress.Enabled {
-		var retriever auth.JwtTokenRetriever
-		var retConfig interface{}
-
-		switch cfg.Egress.Auth.Type {
-		case "static":
-			retriever = new(auth.StaticTokenRetriever)
-			retConfig = &cfg.Egress.Auth.Static
-		case "manual":
-			retriever = new(auth.ManualTokenRetriever)
-			retConfig = &cfg.Egress.Auth.Manual
-		case "gcp":
-			retriever = new(auth.GcpTokenRetriever)
-			retConfig = &cfg.Egress.Auth.Gcp
-		default:
-			log.Fatalln("no auth type specified")
-		}
-
-		err = retriever.Configure(retConfig)
+		retriever, err := configureTokenRetriever(cfg.Egress.Auth.Type, cfg.Audience)
 		if err != nil {
 			log.Fatalf("error configuring auth type: %v\n", err.Error())
 		}
@@ -93,6 +82,34 @@ func main() {
 		}
 
 		manager := auth.NewJwtManager(retriever)
+		manager.SetRenewal(cfg.Egress.Renewal.Fraction, cfg.Egress.Renewal.Skew)
+		if cfg.Egress.Cache.Path != "" {
+			err = manager.SetCache(cfg.Egress.Cache.Path, []byte(cfg.Egress.Cache.Key), tokenCacheFingerprint())
+			if err != nil {
+				log.Fatalf("error configuring token cache: %v\n", err.Error())
+			}
+		}
+		_, err = manager.Token(audSlice[0])
+		if err != nil {
+			log.Printf("unable to obtain initial token: %v\n", err)
+		}
+		manager.Start()
+		var publisher keyPublisher
+		if signer := manualSigner(retriever); signer != nil {
+			_, err = signer.Jwks()
+			if err != nil {
+				log.Printf("not publishing signing keys: %v\n", err)
+			} else {
+				publisher = signer
+			}
+		}
+		adminHandler = newAdminHandler(manager, publisher)
+		proxy.Transport = &tokenRetryTransport{
+			next:    proxy.Transport,
+			manager: manager,
+			aud:     audSlice[0],
+		}
+
 		http.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
 			if modifyRequestAuthz(rw, req, manager, audSlice[0]) {
 				req.Host = targetUrl.Host
@@ -113,22 +130,61 @@ func main() {
 		if validClaims.HasClaim("aud") {
 			log.Fatal("audience claim must be specified in config, not in valid claims")
 		}
+		if cfg.Ingress.Issuer != "" && validClaims.HasClaim("iss") {
+			log.Fatal("issuer claim must be specified in config, not in valid claims")
+		}
 		audSlice, err := convertAudienceString(cfg.Audience)
 		if err != nil {
 			log.Fatalf("error parsing audience: %v\n", err.Error())
 		}
 		validClaims.AddClaim("aud", audSlice[0])
 
-		if cfg.Ingress.JwksUrl != "" {
+		if cfg.Ingress.Issuer != "" {
+			manager, err = auth.NewIssuerKeyManager(cfg.Ingress.Issuer, validClaims)
+			if err != nil {
+				log.Fatalf("error configuring issuer: %v\n", err)
+			}
+		} else if cfg.Ingress.JwksUrl != "" {
 			manager = auth.NewJwksKeyManager(cfg.Ingress.JwksUrl, validClaims)
-		} else if cfg.Ingress.KeyData != "" {
-			key := detectValidatingKey([]byte(cfg.Ingress.KeyData))
-			manager = auth.NewManualKeyManager(key, validClaims)
-		} else if cfg.Ingress.StaticToken != "" {
-			manager = auth.NewStaticKeyManager(cfg.Ingress.StaticToken, validClaims)
+		} else if cfg.Ingress.KeyData != "" || cfg.Ingress.KeyFile != "" {
+			keyManager := auth.NewManualKeyManager(nil, validClaims)
+			err = auth.WatchSecret(
+				cfg.Ingress.KeyData, cfg.Ingress.KeyFile, cfg.Ingress.ReloadInterval, loadValidatingKey(keyManager),
+			)
+			if err != nil {
+				log.Fatalf("error loading validating key: %v\n", err)
+			}
+			manager = keyManager
+		} else if cfg.Ingress.Keyring != "" {
+			manager, err = auth.NewManualKeyringManager(
+				cfg.Ingress.Keyring, cfg.Ingress.ReloadInterval, detectValidatingKey, validClaims,
+			)
+			if err != nil {
+				log.Fatalf("error configuring validating keyring: %v\n", err)
+			}
+		} else if cfg.Ingress.StaticToken != "" || cfg.Ingress.StaticTokenFile != "" {
+			tokenManager := auth.NewStaticKeyManager("", validClaims)
+			err = auth.WatchSecret(
+				cfg.Ingress.StaticToken, cfg.Ingress.StaticTokenFile, cfg.Ingress.ReloadInterval, func(b []byte) error {
+					if len(b) == 0 {
+						return errors.New("static token must not be empty")
+					}
+					tokenManager.SetToken(string(b))
+					return nil
+				},
+			)
+			if err != nil {
+				log.Fatalf("error loading static token: %v\n", err)
+			}
+			manager = tokenManager
+		} else if cfg.Ingress.Spiffe.Enabled {
+			manager = auth.NewSpiffeKeyManager(
+				cfg.Ingress.Spiffe.SocketPath, cfg.Ingress.Spiffe.SpiffeId, cfg.Ingress.Spiffe.TrustDomain, validClaims,
+			)
 		} else {
 			log.Fatalln("failed to configure ingress")
 		}
+		adminHandler = newAdminHandler(nil, nil)
 
 		http.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
 			if validateRequestAuthz(rw, req, manager) {
@@ -142,6 +198,21 @@ func main() {
 
 	}
 
+	if cfg.AdminPort != 0 {
+		adminAddress := cfg.AdminAddress
+		if adminAddress == "" {
+			adminAddress = cfg.Address
+		}
+		adminAddr := fmt.Sprintf("%v:%v", adminAddress, cfg.AdminPort)
+		log.Printf("admin listening on %v\n", adminAddr)
+		go func() {
+			if cfg.TLS.AdminListen {
+				log.Fatalln(http.ListenAndServeTLS(adminAddr, cfg.TLS.Cert, cfg.TLS.Key, adminHandler))
+			}
+			log.Fatalln(http.ListenAndServe(adminAddr, adminHandler))
+		}()
+	}
+
 	addr := fmt.Sprintf("%v:%v", cfg.Address, cfg.Port)
 
 	log.Printf("listening on %v\n", addr)
@@ -155,3 +226,152 @@ func main() {
 	}
 
 }
+
+// configureTokenRetriever creates and configures the JwtTokenRetriever for
+// the egress auth type, which is used to obtain tokens for the audience. A
+// comma separated list of auth types configures a chain that falls back to
+// each auth type in order.
+func configureTokenRetriever(authType string, aud string) (auth.JwtTokenRetriever, error) {
+	var retriever auth.JwtTokenRetriever
+	var retConfig interface{}
+
+	if strings.Contains(authType, ",") {
+		return configureTokenRetrieverChain(strings.Split(authType, ","), aud)
+	}
+
+	switch authType {
+	case "static":
+		retriever = new(auth.StaticTokenRetriever)
+		retConfig = &cfg.Egress.Auth.Static
+	case "manual":
+		retriever = new(auth.ManualTokenRetriever)
+		retConfig = &cfg.Egress.Auth.Manual
+	case "gcp":
+		retriever = new(auth.GcpTokenRetriever)
+		retConfig = &cfg.Egress.Auth.Gcp
+	case "kubernetes":
+		retriever = new(auth.KubernetesTokenRetriever)
+		cfg.Egress.Auth.Kubernetes.Audience = aud
+		retConfig = &cfg.Egress.Auth.Kubernetes
+	case "kubernetes-api":
+		retriever = new(auth.KubernetesApiTokenRetriever)
+		retConfig = &cfg.Egress.Auth.KubernetesApi
+	case "spiffe":
+		retriever = new(auth.SpiffeTokenRetriever)
+		retConfig = &cfg.Egress.Auth.Spiffe
+	case "azure":
+		retriever = new(auth.AzureTokenRetriever)
+		retConfig = &cfg.Egress.Auth.Azure
+	case "aws":
+		retriever = new(auth.AwsTokenRetriever)
+		retConfig = &cfg.Egress.Auth.Aws
+	case "github-actions":
+		retriever = new(auth.GithubActionsTokenRetriever)
+		retConfig = &cfg.Egress.Auth.GithubActions
+	case "gitlab-ci":
+		retriever = new(auth.GitlabCiTokenRetriever)
+		retConfig = &cfg.Egress.Auth.GitlabCi
+	case "vault":
+		retriever = new(auth.VaultTokenRetriever)
+		cfg.Egress.Auth.Vault.Audience = aud
+		retConfig = &cfg.Egress.Auth.Vault
+	case "oauth2":
+		retriever = new(auth.Oauth2TokenRetriever)
+		retConfig = &cfg.Egress.Auth.Oauth2
+	case "exec":
+		retriever = new(auth.ExecTokenRetriever)
+		retConfig = &cfg.Egress.Auth.Exec
+	case "token-exchange":
+		subjectAuthType := cfg.Egress.Auth.TokenExchange.SubjectAuthType
+		for _, t := range strings.Split(subjectAuthType, ",") {
+			if strings.TrimSpace(t) == "token-exchange" {
+				return nil, errors.New("subject token auth type must not be token-exchange")
+			}
+		}
+		subjectAudience := cfg.Egress.Auth.TokenExchange.SubjectAudience
+		if subjectAudience == "" {
+			subjectAudience = aud
+		}
+		subject, err := configureTokenRetriever(subjectAuthType, subjectAudience)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring subject token auth type: %w", err)
+		}
+		retriever = new(auth.ExchangeTokenRetriever)
+		cfg.Egress.Auth.TokenExchange.Subject = subject
+		retConfig = &cfg.Egress.Auth.TokenExchange
+	case "":
+		return nil, errors.New("no auth type specified")
+	default:
+		return nil, fmt.Errorf("unknown auth type: %v", authType)
+	}
+
+	err := retriever.Configure(retConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return retriever, nil
+}
+
+// configureTokenRetrieverChain configures a ChainTokenRetriever for the auth
+// types. Auth types that are not available in the current environment are
+// left out of the chain, while any other error configuring an auth type is
+// returned.
+func configureTokenRetrieverChain(authTypes []string, aud string) (auth.JwtTokenRetriever, error) {
+	// The chain is built in its own config, since configuring an auth type
+	// may configure a nested chain, such as the subject token of a token
+	// exchange.
+	chainConfig := &auth.ChainTokenConfig{
+		FailureThreshold: cfg.Egress.Auth.Chain.FailureThreshold,
+		OpenDuration:     cfg.Egress.Auth.Chain.OpenDuration,
+	}
+	for _, authType := range authTypes {
+		authType = strings.TrimSpace(authType)
+		retriever, err := configureTokenRetriever(authType, aud)
+		if errors.Is(err, auth.ErrUnavailable) {
+			log.Printf("skipping auth type %v: %v\n", authType, err)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error configuring auth type %v: %w", authType, err)
+		}
+		chainConfig.Names = append(chainConfig.Names, authType)
+		chainConfig.Retrievers = append(chainConfig.Retrievers, retriever)
+	}
+
+	retriever := new(auth.ChainTokenRetriever)
+	err := retriever.Configure(chainConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("configured auth type chain: %v\n", strings.Join(chainConfig.Names, ", "))
+	return retriever, nil
+}
+
+// manualSigner returns the ManualTokenRetriever used by the retriever, which
+// may be one of the retrievers in a chain, or nil if there is none.
+func manualSigner(retriever auth.JwtTokenRetriever) *auth.ManualTokenRetriever {
+	if chain, ok := retriever.(*auth.ChainTokenRetriever); ok {
+		for _, r := range chain.Retrievers() {
+			if signer := manualSigner(r); signer != nil {
+				return signer
+			}
+		}
+	}
+	signer, _ := retriever.(*auth.ManualTokenRetriever)
+	return signer
+}
+
+// tokenCacheFingerprint returns a fingerprint of the egress auth type and
+// configuration, so that cached tokens are discarded when they change.
+func tokenCacheFingerprint() string {
+	authConfig := cfg.Egress.Auth
+	authConfig.TokenExchange.Subject = nil
+	b, err := json.Marshal(authConfig)
+	if err != nil {
+		log.Fatalf("error fingerprinting auth configuration: %v\n", err.Error())
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
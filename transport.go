@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/mbrancato/oidc-proxy/auth"
+)
+
+// invalidTokenChallenge matches a WWW-Authenticate Bearer challenge with the
+// invalid_token error code, as described in RFC 6750.
+var invalidTokenChallenge = regexp.MustCompile(`(?i)^\s*bearer\b.*\berror\s*=\s*"?invalid_token\b`)
+
+// tokenRetryTransport is an http.RoundTripper used in egress mode. When the
+// target rejects the token with an invalid_token challenge, the cached token
+// is invalidated and the request is sent once more with a new token. The
+// JwtManager limits how often tokens are invalidated, so a target that
+// rejects every token does not cause a new token to be fetched per request.
+type tokenRetryTransport struct {
+	next    http.RoundTripper
+	manager *auth.JwtManager
+	aud     string
+}
+
+// RoundTrip sends the request, and replays it with a new token if the token
+// was rejected.
+func (t *tokenRetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !isInvalidTokenChallenge(resp.Header.Values("WWW-Authenticate")) {
+		return resp, err
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, nil
+	}
+
+	token, _ := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !t.manager.Invalidate(t.aud, token) {
+		return resp, nil
+	}
+	newToken, err := t.manager.RequestToken(t.aud, req)
+	if err != nil || newToken == token {
+		return resp, nil
+	}
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+	}
+	retry.Header.Set("Authorization", "Bearer "+newToken)
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	return t.next.RoundTrip(retry)
+}
+
+// isInvalidTokenChallenge returns true if any of the WWW-Authenticate header
+// values is a Bearer challenge with the invalid_token error code.
+func isInvalidTokenChallenge(values []string) bool {
+	for _, v := range values {
+		if invalidTokenChallenge.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mbrancato/oidc-proxy/auth"
+)
+
+// sequenceTokenRetriever returns a new token with a distinct subject on each
+// call.
+type sequenceTokenRetriever struct {
+	t     *testing.T
+	calls atomic.Int32
+}
+
+func (r *sequenceTokenRetriever) GetToken(aud string) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(
+		jwt.SigningMethodHS256, jwt.MapClaims{
+			"aud": aud,
+			"iss": "https://foo",
+			"sub": fmt.Sprintf("token-%v", r.calls.Add(1)),
+			"iat": now.Unix(),
+			"exp": now.Add(time.Hour).Unix(),
+		},
+	)
+	tokenString, err := token.SignedString([]byte("testing"))
+	assert.NoError(r.t, err)
+	return tokenString, nil
+}
+
+func (r *sequenceTokenRetriever) Configure(_ interface{}) error {
+	return nil
+}
+
+func TestTokenRetryTransport(t *testing.T) {
+	retriever := &sequenceTokenRetriever{t: t}
+	manager := auth.NewJwtManager(retriever)
+	rejected, err := manager.Token("foo")
+	assert.NoError(t, err)
+
+	var requests atomic.Int32
+	challenge := `Bearer realm="test", error="invalid_token", error_description="the token was revoked"`
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(rw http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				body, _ := io.ReadAll(r.Body)
+				assert.Equal(t, "payload", string(body))
+				if r.Header.Get("Authorization") == "Bearer "+rejected {
+					rw.Header().Set("WWW-Authenticate", challenge)
+					rw.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				rw.WriteHeader(http.StatusOK)
+			},
+		),
+	)
+	defer server.Close()
+
+	transport := &tokenRetryTransport{
+		next:    http.DefaultTransport,
+		manager: manager,
+		aud:     "foo",
+	}
+	newRequest := func(token string) *http.Request {
+		body := []byte("payload")
+		req, err := http.NewRequest("POST", server.URL, bytes.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req
+	}
+
+	// A rejected token is replaced and the request is replayed once.
+	resp, err := transport.RoundTrip(newRequest(rejected))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(2), requests.Load())
+	assert.Equal(t, int32(2), retriever.calls.Load())
+
+	renewed, err := manager.Token("foo")
+	assert.NoError(t, err)
+	assert.NotEqual(t, rejected, renewed)
+
+	// Other authentication failures are returned without a replay.
+	challenge = `Bearer realm="test", error="insufficient_scope"`
+	requests.Store(0)
+	resp, err = transport.RoundTrip(newRequest(rejected))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, int32(1), requests.Load())
+	assert.Equal(t, int32(2), retriever.calls.Load())
+}
+
+func TestTokenRetryTransport_RepeatedRejection(t *testing.T) {
+	retriever := &sequenceTokenRetriever{t: t}
+	manager := auth.NewJwtManager(retriever)
+
+	var requests atomic.Int32
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(rw http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				rw.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				rw.WriteHeader(http.StatusUnauthorized)
+			},
+		),
+	)
+	defer server.Close()
+
+	transport := &tokenRetryTransport{
+		next:    http.DefaultTransport,
+		manager: manager,
+		aud:     "foo",
+	}
+
+	// A target that rejects every token only causes a single new token to be
+	// fetched within the minimum renewal interval.
+	for i := 0; i < 10; i++ {
+		token, err := manager.Token("foo")
+		assert.NoError(t, err)
+		req, err := http.NewRequest("GET", server.URL, nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := transport.RoundTrip(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		_ = resp.Body.Close()
+	}
+	assert.Equal(t, int32(2), retriever.calls.Load())
+	assert.Equal(t, int32(11), requests.Load())
+}
+
+func TestIsInvalidTokenChallenge(t *testing.T) {
+	assert.True(t, isInvalidTokenChallenge([]string{`Bearer error="invalid_token"`}))
+	assert.True(t, isInvalidTokenChallenge([]string{`Basic realm="test"`, `bearer realm="test", error=invalid_token`}))
+	assert.False(t, isInvalidTokenChallenge([]string{`Bearer realm="test"`}))
+	assert.False(t, isInvalidTokenChallenge([]string{`Basic error="invalid_token"`}))
+	assert.False(t, isInvalidTokenChallenge(nil))
+}